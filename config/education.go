@@ -0,0 +1,71 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// EducationLevel is the range of ages, as of 1 January of the school year, for one level of education
+type EducationLevel struct {
+	Name   string `json:"name"`
+	MinAge int    `json:"min_age"`
+	MaxAge *int   `json:"max_age,omitempty"` // nil for no upper bound
+}
+
+// Education levels used by both applicants and scheme criteria, youngest first
+var EducationLevels []EducationLevel
+
+// Default bands follow the Singapore school system, e.g. a child starts primary school in the year they turn 7
+func defaultEducationLevels() []EducationLevel {
+	maxAge := func(age int) *int { return &age }
+	return []EducationLevel{
+		{Name: "kindergarten", MinAge: 0, MaxAge: maxAge(5)},
+		{Name: "primary", MinAge: 6, MaxAge: maxAge(11)},
+		{Name: "secondary", MinAge: 12, MaxAge: maxAge(15)},
+		{Name: "tertiary", MinAge: 16, MaxAge: maxAge(17)},
+		{Name: "higher", MinAge: 18},
+	}
+}
+
+// Load the education levels from the JSON file at EDUCATION_LEVELS_FILE, or use the defaults
+func LoadEducationLevels() {
+	path := os.Getenv("EDUCATION_LEVELS_FILE")
+	if path == "" {
+		EducationLevels = defaultEducationLevels()
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading education levels file: %v", err)
+	}
+	var levels []EducationLevel
+	if err := json.Unmarshal(data, &levels); err != nil {
+		log.Fatalf("Error parsing education levels file: %v", err)
+	}
+
+	// Bands must be in order and must not overlap or leave gaps, so that every age has exactly one level
+	if len(levels) == 0 || levels[0].MinAge != 0 {
+		log.Fatal("Education levels must start at age 0")
+	}
+	for i, level := range levels {
+		if level.Name == "" {
+			log.Fatalf("Education level %d has no name", i)
+		}
+		if level.MaxAge != nil && *level.MaxAge < level.MinAge {
+			log.Fatalf("Education level %q ends before it starts", level.Name)
+		}
+		if i == len(levels)-1 {
+			break
+		}
+		if level.MaxAge == nil || levels[i+1].MinAge != *level.MaxAge+1 {
+			log.Fatalf("Education level %q must end the year before %q starts", level.Name, levels[i+1].Name)
+		}
+	}
+	if levels[len(levels)-1].MaxAge != nil {
+		log.Fatalf("The last education level %q must not have a max_age", levels[len(levels)-1].Name)
+	}
+
+	EducationLevels = levels
+}
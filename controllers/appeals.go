@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for appeals, optionally filtered by ?application=, ?status= and ?reviewer=
+func GetAppeals(w http.ResponseWriter, r *http.Request) {
+	where := `WHERE TRUE`
+	values := []interface{}{}
+	for _, filter := range []struct{ param, column string }{
+		{"application", "application_id::text"}, {"status", "status"}, {"reviewer", "reviewer"},
+	} {
+		if value := r.URL.Query().Get(filter.param); value != "" {
+			values = append(values, value)
+			where += fmt.Sprintf(" AND %s = $%d", filter.column, len(values))
+		}
+	}
+
+	appeals, err := fetchAppeals(where, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching appeals: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, appeals)
+}
+
+// POST request to appeal a rejected application
+// - The X-User header records who filed it
+func FileAppeal(w http.ResponseWriter, r *http.Request) {
+	var appeal models.Appeal
+	if err := json.NewDecoder(r.Body).Decode(&appeal); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if appeal.ApplicationID == "" || appeal.Grounds == "" {
+		http.Error(w, "application_id and grounds are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT status FROM applications WHERE id = $1 FOR UPDATE`, appeal.ApplicationID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if status != "rejected" {
+		http.Error(w, "only rejected applications can be appealed", http.StatusConflict)
+		return
+	}
+
+	appeal.ID = uuid.New().String()
+	_, err = tx.Exec(`INSERT INTO appeals (id, application_id, grounds, filed_by) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		appeal.ID, appeal.ApplicationID, appeal.Grounds, utils.RequestUser(r))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "application already has an open appeal", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error filing appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondWithAppeal(w, appeal.ID, http.StatusCreated)
+}
+
+// POST request to assign an open appeal to a reviewer
+// - The reviewer cannot be whoever rejected the application
+func AssignAppeal(w http.ResponseWriter, r *http.Request) {
+	appealID := mux.Vars(r)["id"]
+
+	var assignment models.AppealAssignment
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if assignment.Reviewer == "" {
+		http.Error(w, "reviewer is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	var decidedBy sql.NullString
+	err = tx.QueryRow(`
+		SELECT appeals.status, applications.decided_by
+		FROM appeals JOIN applications ON applications.id = appeals.application_id
+		WHERE appeals.id = $1
+		FOR UPDATE OF appeals`, appealID).Scan(&status, &decidedBy)
+	if err == sql.ErrNoRows {
+		http.Error(w, "appeal not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if status != "open" {
+		http.Error(w, "appeal has already been decided", http.StatusConflict)
+		return
+	}
+	if decidedBy.Valid && decidedBy.String == assignment.Reviewer {
+		http.Error(w, "the reviewer must be someone other than who rejected the application", http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE appeals SET reviewer = $1, assigned_at = NOW() WHERE id = $2`, assignment.Reviewer, appealID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error assigning appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondWithAppeal(w, appealID, http.StatusOK)
+}
+
+// POST request for the assigned reviewer to decide an appeal
+// - The X-User header must name the reviewer
+// - Overturning it approves the application, which schedules its payments
+func DecideAppeal(w http.ResponseWriter, r *http.Request) {
+	appealID := mux.Vars(r)["id"]
+
+	var decision models.AppealDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if decision.Outcome != "upheld" && decision.Outcome != "overturned" {
+		http.Error(w, "outcome must be upheld or overturned", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var applicationID, status, applicationStatus string
+	var reviewer sql.NullString
+	err = tx.QueryRow(`
+		SELECT appeals.application_id, appeals.status, appeals.reviewer, applications.status
+		FROM appeals JOIN applications ON applications.id = appeals.application_id
+		WHERE appeals.id = $1
+		FOR UPDATE`, appealID).Scan(&applicationID, &status, &reviewer, &applicationStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "appeal not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if status != "open" {
+		http.Error(w, "appeal has already been decided", http.StatusConflict)
+		return
+	}
+	if !reviewer.Valid {
+		http.Error(w, "appeal has not been assigned to a reviewer", http.StatusConflict)
+		return
+	}
+	if utils.RequestUser(r) != reviewer.String {
+		http.Error(w, "only the assigned reviewer can decide the appeal", http.StatusForbidden)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE appeals SET status = $1, decision_notes = NULLIF($2, ''), decided_at = NOW() WHERE id = $3`,
+		decision.Outcome, decision.Notes, appealID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deciding appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Overturning the rejection approves the application, as if the reviewer had approved it
+	if decision.Outcome == "overturned" {
+		if applicationStatus != "rejected" {
+			http.Error(w, fmt.Sprintf("application is %s, not rejected", applicationStatus), http.StatusConflict)
+			return
+		}
+		_, err = tx.Exec(`UPDATE applications SET status = 'approved', decided_at = NOW(), decided_by = $1 WHERE id = $2`,
+			reviewer.String, applicationID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error approving application: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err = recordStatusChange(tx, applicationID, &applicationStatus, "approved", reviewer.String, &appealID); err != nil {
+			http.Error(w, fmt.Sprintf("Error recording status history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !withinApplicationLimits(w, tx, applicationID, false) || !approveWithinGroups(w, tx, applicationID) ||
+			!documentsVerified(w, tx, applicationID) {
+			return
+		}
+		if err = generateDisbursements(tx, applicationID); err != nil {
+			http.Error(w, fmt.Sprintf("Error scheduling disbursements: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondWithAppeal(w, appealID, http.StatusOK)
+}
+
+// Respond with an appeal as it now is
+func respondWithAppeal(w http.ResponseWriter, appealID string, status int) {
+	appeals, err := fetchAppeals(`WHERE id = $1`, appealID)
+	if err != nil || len(appeals) == 0 {
+		http.Error(w, fmt.Sprintf("Error fetching appeal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, status, appeals[0])
+}
+
+// Fetch appeals matching a WHERE clause, oldest first
+func fetchAppeals(where string, args ...interface{}) ([]models.Appeal, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, application_id, grounds, status, filed_by, reviewer, decision_notes, filed_at, assigned_at, decided_at
+		FROM appeals `+where+`
+		ORDER BY filed_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appeals := []models.Appeal{}
+	for rows.Next() {
+		var appeal models.Appeal
+		err := rows.Scan(&appeal.ID, &appeal.ApplicationID, &appeal.Grounds, &appeal.Status, &appeal.FiledBy, &appeal.Reviewer,
+			&appeal.DecisionNotes, &appeal.FiledAt, &appeal.AssignedAt, &appeal.DecidedAt)
+		if err != nil {
+			return nil, err
+		}
+		appeals = append(appeals, appeal)
+	}
+	return appeals, rows.Err()
+}
@@ -1,25 +1,43 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
 	"github.com/neozhixuan/gt_assessment/models"
 	"github.com/neozhixuan/gt_assessment/utils"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 // GET Request on Applicants table
 // - Each request requires 2 objects from net/http: ResponseWriter and a Request
+// - An optional ?name= or ?national_id= does an exact-match lookup through the blind indexes
 func GetApplicants(w http.ResponseWriter, r *http.Request) {
 	// Initialise an empty list variable to store our list of applicants
 	var applicants []models.Applicant
 
-	// Query the database for all rows in applicants table
-	rows, err := database.DB.Query(`SELECT id, name, employment_status, sex, date_of_birth FROM applicants`)
+	// Query the database for all rows in applicants table, or the ones matching the lookups
+	query := `
+		SELECT id, name, employment_status, sex, date_of_birth, COALESCE(national_id, ''), ` + currentMaritalStatus + `, education_level_override
+		FROM applicants WHERE TRUE`
+	values := []interface{}{}
+	if name := r.URL.Query().Get("name"); name != "" {
+		values = append(values, encryption.BlindIndex(name))
+		query += " AND name_index = $" + fmt.Sprint(len(values))
+	}
+	if nationalID := r.URL.Query().Get("national_id"); nationalID != "" {
+		values = append(values, encryption.BlindIndex(utils.NormaliseNationalID(nationalID)))
+		query += " AND national_id_index = $" + fmt.Sprint(len(values))
+	}
+	rows, err := database.DB.Query(query, values...)
 	// Error control by writing into the ResponseWriter + closing the DB
 	if err != nil {
 		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch applicants: %v", err))
@@ -32,10 +50,20 @@ func GetApplicants(w http.ResponseWriter, r *http.Request) {
 		// Initialise an empty variable to store each applicant
 		var applicant models.Applicant
 		// Fetch each individual data into the empty applicants variable
-		if err := rows.Scan(&applicant.ID, &applicant.Name, &applicant.EmploymentStatus, &applicant.Sex, &applicant.DateOfBirth); err != nil {
+		if err := rows.Scan(&applicant.ID, &applicant.Name, &applicant.EmploymentStatus, &applicant.Sex, &applicant.DateOfBirth, &applicant.NationalID, &applicant.MaritalStatus, &applicant.EducationLevelOverride); err != nil {
 			utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error scanning applicants: %v", err))
 			return
 		}
+		// Decrypt the sensitive fields before returning them
+		if err := decryptApplicant(&applicant); err != nil {
+			utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error decrypting applicants: %v", err))
+			return
+		}
+		// Work out the applicant's current education level
+		// - A row saved before dates of birth were checked is logged and left without one, rather than failing the whole list
+		if err := setEducationLevel(&applicant); err != nil {
+			log.Printf("Error calculating education level for applicant %s: %v", applicant.ID, err)
+		}
 		// Append it to our list of applicants initialised at the top
 		applicants = append(applicants, applicant)
 	}
@@ -57,16 +85,112 @@ func CreateApplicant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The date of birth is stored encrypted, so the database can no longer check it for us
+	if err := utils.ValidateDateOfBirth(applicant.DateOfBirth); err != nil {
+		utils.SendJSONResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Applicants are single unless told otherwise
+	if applicant.MaritalStatus == "" {
+		applicant.MaritalStatus = "single"
+	}
+	if !utils.IsValidMaritalStatus(applicant.MaritalStatus) {
+		utils.SendJSONResponse(w, http.StatusBadRequest, "marital_status must be one of single, married, widowed or divorced")
+		return
+	}
+
+	// An education level override must come from the same vocabulary as scheme criteria
+	if applicant.EducationLevelOverride != nil && *applicant.EducationLevelOverride == "" {
+		applicant.EducationLevelOverride = nil
+	}
+	if applicant.EducationLevelOverride != nil && !utils.IsValidEducationLevel(*applicant.EducationLevelOverride) {
+		utils.SendJSONResponse(w, http.StatusBadRequest, "Unknown education_level_override, see /api/reference/education-levels")
+		return
+	}
+
+	// A national ID is optional, but must be valid when given, as it is how we tell people apart
+	var nationalIDIndex string
+	if applicant.NationalID != "" {
+		applicant.NationalID = utils.NormaliseNationalID(applicant.NationalID)
+		if err := utils.ValidateNationalID(applicant.NationalID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid national_id: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Return the existing applicant if this person has already been registered
+		nationalIDIndex = encryption.BlindIndex(applicant.NationalID)
+		if sendDuplicateApplicant(w, nationalIDIndex) {
+			return
+		}
+	}
+
 	// Generate a new UUID for the applicant
 	applicant.ID = uuid.New().String()
 
+	// Encrypt the sensitive fields
+	encryptedName, err := encryption.Encrypt(applicant.Name)
+	if err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error encrypting applicant: %v", err))
+		return
+	}
+	encryptedDOB, err := encryption.Encrypt(applicant.DateOfBirth)
+	if err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error encrypting applicant: %v", err))
+		return
+	}
+	var encryptedNationalID string
+	if applicant.NationalID != "" {
+		encryptedNationalID, err = encryption.Encrypt(applicant.NationalID)
+		if err != nil {
+			utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error encrypting applicant: %v", err))
+			return
+		}
+	}
+
+	// Start a transaction so that the applicant and the start of their history are saved together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error starting tx: %v", err))
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert applicant into the database
-	query := `INSERT INTO applicants (id, name, employment_status, sex, date_of_birth) VALUES ($1, $2, $3, $4, $5)`
-	_, err = database.DB.Exec(query, applicant.ID, applicant.Name, applicant.EmploymentStatus, applicant.Sex, applicant.DateOfBirth)
+	query := `
+		INSERT INTO applicants (id, name, name_index, employment_status, sex, date_of_birth, national_id, national_id_index,
+			marital_status, education_level_override)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err = tx.Exec(query, applicant.ID, encryptedName, encryption.BlindIndex(applicant.Name),
+		applicant.EmploymentStatus, applicant.Sex, encryptedDOB, utils.NilIfEmpty(encryptedNationalID), utils.NilIfEmpty(nationalIDIndex),
+		applicant.MaritalStatus, applicant.EducationLevelOverride)
+	// Another request may have registered the same person since we checked
+	if isUniqueViolation(err) && nationalIDIndex != "" && sendDuplicateApplicant(w, nationalIDIndex) {
+		return
+	}
 	if err != nil {
 		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error creating applicant: %v", err))
 		return
 	}
+
+	// The status the applicant registered with starts their marital status history
+	_, err = tx.Exec(`INSERT INTO marital_status_history (id, applicant_id, marital_status) VALUES ($1, $2, $3)`,
+		uuid.New().String(), applicant.ID, applicant.MaritalStatus)
+	if err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error creating marital status history: %v", err))
+		return
+	}
+
+	// Work out the applicant's current education level for the response, before anything is saved
+	if err := setEducationLevel(&applicant); err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error calculating education level: %v", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		utils.SendJSONResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error committing tx: %v", err))
+		return
+	}
 	// Write our response using ResponseWriter
 	utils.SendJSONResponse(w, http.StatusCreated, applicant)
 }
@@ -87,6 +211,12 @@ func UpdateApplicant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Marital status has its own history and spouse links to keep in sync
+	if applicant.MaritalStatus != "" {
+		http.Error(w, "marital_status is changed through PUT /api/applicants/marital-status", http.StatusBadRequest)
+		return
+	}
+
 	// Build update query dynamically based on non-empty fields
 	// Stores data into a slice "[]" (dynamic array) of interface{} types
 	query := "UPDATE applicants SET "
@@ -97,8 +227,17 @@ func UpdateApplicant(w http.ResponseWriter, r *http.Request) {
 	counter := 1
 
 	if applicant.Name != "" {
+		encryptedName, err := encryption.Encrypt(applicant.Name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
 		query += "name = $" + fmt.Sprint(counter) + ", "
-		values = append(values, applicant.Name)
+		values = append(values, encryptedName)
+		counter++
+
+		query += "name_index = $" + fmt.Sprint(counter) + ", "
+		values = append(values, encryption.BlindIndex(applicant.Name))
 		counter++
 	}
 
@@ -109,14 +248,57 @@ func UpdateApplicant(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if applicant.Sex != "" {
-		query += "employment_status = $" + fmt.Sprint(counter) + ", "
+		query += "sex = $" + fmt.Sprint(counter) + ", "
 		values = append(values, applicant.Sex)
 		counter++
 	}
 
 	if applicant.DateOfBirth != "" {
-		query += "employment_status = $" + fmt.Sprint(counter) + ", "
-		values = append(values, applicant.DateOfBirth)
+		if err := utils.ValidateDateOfBirth(applicant.DateOfBirth); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encryptedDOB, err := encryption.Encrypt(applicant.DateOfBirth)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		query += "date_of_birth = $" + fmt.Sprint(counter) + ", "
+		values = append(values, encryptedDOB)
+		counter++
+	}
+
+	// An empty override clears it, so the education level is derived from age again
+	if applicant.EducationLevelOverride != nil {
+		if *applicant.EducationLevelOverride != "" && !utils.IsValidEducationLevel(*applicant.EducationLevelOverride) {
+			http.Error(w, "Unknown education_level_override, see /api/reference/education-levels", http.StatusBadRequest)
+			return
+		}
+		query += "education_level_override = $" + fmt.Sprint(counter) + ", "
+		values = append(values, utils.NilIfEmpty(*applicant.EducationLevelOverride))
+		counter++
+	}
+
+	var nationalIDIndex string
+	if applicant.NationalID != "" {
+		applicant.NationalID = utils.NormaliseNationalID(applicant.NationalID)
+		if err := utils.ValidateNationalID(applicant.NationalID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid national_id: %v", err), http.StatusBadRequest)
+			return
+		}
+		encryptedNationalID, err := encryption.Encrypt(applicant.NationalID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		nationalIDIndex = encryption.BlindIndex(applicant.NationalID)
+
+		query += "national_id = $" + fmt.Sprint(counter) + ", "
+		values = append(values, encryptedNationalID)
+		counter++
+
+		query += "national_id_index = $" + fmt.Sprint(counter) + ", "
+		values = append(values, nationalIDIndex)
 		counter++
 	}
 
@@ -124,15 +306,41 @@ func UpdateApplicant(w http.ResponseWriter, r *http.Request) {
 	query = query[:len(query)-2]
 
 	// Add WHERE clause
-	query += " WHERE id = $" + fmt.Sprint(counter)
+	// - An anonymised applicant's details must not be filled back in
+	query += " WHERE id = $" + fmt.Sprint(counter) + " AND anonymised_at IS NULL"
 	values = append(values, applicantID)
 
 	// Execute the query
-	_, err := database.DB.Exec(query, values...)
+	result, err := database.DB.Exec(query, values...)
+	// The national ID may already belong to someone else
+	if isUniqueViolation(err) && sendDuplicateApplicant(w, nationalIDIndex) {
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error updating applicants: %v", err), http.StatusInternalServerError)
 		return
 	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating applicants: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		var anonymised bool
+		err = database.DB.QueryRow(`SELECT anonymised_at IS NOT NULL FROM applicants WHERE id = $1`, applicantID).Scan(&anonymised)
+		if err == sql.ErrNoRows {
+			http.Error(w, "applicant not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if anonymised {
+			http.Error(w, "applicant has been anonymised and cannot be updated", http.StatusConflict)
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Applicant updated successfully"))
 }
@@ -145,14 +353,117 @@ func DeleteApplicant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Start a transaction so that the applicant and their applications are deleted together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Delete the attachments on their applications, noting where the files are kept
+	rows, err := tx.Query(`
+		DELETE FROM application_attachments
+		WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)
+		RETURNING storage_key`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			http.Error(w, fmt.Sprintf("Error scanning attachment: %v", err), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Delete their applications, whose notes, history and payments go with them
+	_, err = tx.Exec(`DELETE FROM applications WHERE applicant_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete applicant from DB
 	query := `DELETE FROM applicants WHERE id = $1`
-	_, err := database.DB.Exec(query, applicantID)
+	_, err = tx.Exec(query, applicantID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error deletings applicants: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// Commit the transaction before removing the files, so they are only lost if the rows are
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deleteBlobs(keys)
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Applicant deleted successfully"))
 }
+
+// Decrypt the sensitive fields of an applicant read from the database
+func decryptApplicant(applicant *models.Applicant) error {
+	var err error
+	applicant.Name, err = encryption.Decrypt(applicant.Name)
+	if err != nil {
+		return err
+	}
+	applicant.DateOfBirth, err = encryption.Decrypt(applicant.DateOfBirth)
+	if err != nil {
+		return err
+	}
+	applicant.NationalID, err = encryption.Decrypt(applicant.NationalID)
+	return err
+}
+
+// Work out an applicant's education level today, from their override or their age
+func setEducationLevel(applicant *models.Applicant) error {
+	override := ""
+	if applicant.EducationLevelOverride != nil {
+		override = *applicant.EducationLevelOverride
+	}
+
+	level, err := utils.EducationLevelOn(applicant.DateOfBirth, override, time.Now())
+	if err != nil {
+		return err
+	}
+	applicant.EducationLevel = level
+	return nil
+}
+
+// Send a 409 with the ID of the applicant holding a national ID, if there is one
+// - Returns false when nobody holds the national ID, so the caller can carry on
+func sendDuplicateApplicant(w http.ResponseWriter, nationalIDIndex string) bool {
+	var existingID string
+	err := database.DB.QueryRow(`SELECT id FROM applicants WHERE national_id_index = $1`, nationalIDIndex).Scan(&existingID)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking for duplicate applicant: %v", err), http.StatusInternalServerError)
+		return true
+	}
+
+	utils.SendJSONResponse(w, http.StatusConflict, models.DuplicateApplicantResponse{
+		Error:               "an applicant with this national ID already exists",
+		ExistingApplicantID: existingID,
+	})
+	return true
+}
+
+// Check whether an error is a PostgreSQL unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
+)
+
+// GET request for an application's status history, oldest first
+func GetApplicationHistory(w http.ResponseWriter, r *http.Request) {
+	applicationID := r.URL.Query().Get("application")
+	if applicationID == "" {
+		http.Error(w, "application ID is required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := fetchStatusHistory(`WHERE application_id::text = $1`, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching status history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, history)
+}
+
+// Fetch status changes matching a WHERE clause, oldest first
+func fetchStatusHistory(where string, args ...interface{}) ([]models.StatusChange, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, application_id, from_status, to_status, changed_by, appeal_id, changed_at
+		FROM application_status_history `+where+`
+		ORDER BY changed_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.StatusChange{}
+	for rows.Next() {
+		var change models.StatusChange
+		err := rows.Scan(&change.ID, &change.ApplicationID, &change.FromStatus, &change.ToStatus, &change.ChangedBy,
+			&change.AppealID, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// Record a change to an application's status, unless the status stayed the same
+// - from is nil when the application is created
+// - appealID is set when the change was made by deciding an appeal
+// - Applicants are told when their application is decided, and changes after creation are sent to webhook subscribers
+func recordStatusChange(tx *sql.Tx, applicationID string, from *string, to, changedBy string, appealID *string) error {
+	if from != nil && *from == to {
+		return nil
+	}
+	change := models.StatusChange{ID: uuid.New().String(), ApplicationID: applicationID, FromStatus: from, ToStatus: to, AppealID: appealID}
+	err := tx.QueryRow(`
+		INSERT INTO application_status_history (id, application_id, from_status, to_status, changed_by, appeal_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		RETURNING changed_by, changed_at`,
+		change.ID, applicationID, from, to, changedBy, appealID).Scan(&change.ChangedBy, &change.ChangedAt)
+	if err != nil {
+		return err
+	}
+	if err = queueStatusNotification(tx, applicationID, to); err != nil || from == nil {
+		return err
+	}
+	return webhooks.Enqueue(tx, webhooks.ApplicationStatusChanged, change)
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// The columns of a scheme's application limits, in the order they are scanned
+const applicationLimitColumns = `schemes.max_grants, schemes.rejection_cooldown_days, schemes.grant_cooldown_days, schemes.sla_days`
+
+// Check a scheme's application limits, which must be positive when set
+func validateApplicationLimits(limits models.ApplicationLimits) error {
+	for _, limit := range []*int{limits.MaxGrants, limits.RejectionCooldownDays, limits.GrantCooldownDays, limits.SLADays} {
+		if limit != nil && *limit < 1 {
+			return errors.New("max_grants, rejection_cooldown_days, grant_cooldown_days and sla_days must be at least 1")
+		}
+	}
+	return nil
+}
+
+// Apply the limits given in an update, where a limit of 0 removes it
+func mergeApplicationLimits(limits *models.ApplicationLimits, update models.ApplicationLimits) {
+	merge := func(limit **int, value *int) {
+		if value == nil {
+			return
+		}
+		*limit = value
+		if *value == 0 {
+			*limit = nil
+		}
+	}
+	merge(&limits.MaxGrants, update.MaxGrants)
+	merge(&limits.RejectionCooldownDays, update.RejectionCooldownDays)
+	merge(&limits.GrantCooldownDays, update.GrantCooldownDays)
+	merge(&limits.SLADays, update.SLADays)
+}
+
+// Fetch a scheme's application limits
+func fetchApplicationLimits(schemeID string) (models.ApplicationLimits, error) {
+	var limits models.ApplicationLimits
+	err := database.DB.QueryRow(`SELECT `+applicationLimitColumns+` FROM schemes WHERE id = $1`, schemeID).
+		Scan(&limits.MaxGrants, &limits.RejectionCooldownDays, &limits.GrantCooldownDays, &limits.SLADays)
+	return limits, err
+}
+
+// Check an application against its scheme's limits once it has been saved in the transaction
+// - An applicant can only have one undecided application to a scheme at a time
+// - An approval counts towards the scheme's max_grants
+// - When reapplying, which is creating an application or moving it to another scheme, the cooldowns after a rejection or grant must have passed
+// - Returns why the application breaks a limit, or "" if it does not
+func checkApplicationLimits(tx *sql.Tx, applicationID string, reapplying bool) (string, error) {
+	var applicantID, schemeID, status string
+	err := tx.QueryRow(`SELECT applicant_id, scheme_id, status FROM applications WHERE id = $1`, applicationID).
+		Scan(&applicantID, &schemeID, &status)
+	if err != nil {
+		return "", err
+	}
+
+	// Lock the applicant, so that two of their applications cannot pass the checks at the same time
+	// - The application's foreign key already holds a key share lock on them, which FOR UPDATE would deadlock against
+	if _, err = tx.Exec(`SELECT 1 FROM applicants WHERE id = $1 FOR NO KEY UPDATE`, applicantID); err != nil {
+		return "", err
+	}
+
+	limits, err := fetchApplicationLimits(schemeID)
+	if err != nil {
+		return "", err
+	}
+	decided := pq.Array(utils.DecidedApplicationStatuses)
+
+	if !utils.IsDecidedApplicationStatus(status) {
+		var openID string
+		err = tx.QueryRow(`
+			SELECT id FROM applications
+			WHERE applicant_id = $1 AND scheme_id = $2 AND id <> $3 AND status <> ALL($4::text[])
+			LIMIT 1`, applicantID, schemeID, applicationID, decided).Scan(&openID)
+		if err == nil {
+			return fmt.Sprintf("the applicant already has an open application %s for this scheme", openID), nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	if status == "approved" && limits.MaxGrants != nil {
+		var grants int
+		err = tx.QueryRow(`
+			SELECT COUNT(*) FROM applications
+			WHERE applicant_id = $1 AND scheme_id = $2 AND id <> $3 AND status = 'approved'`,
+			applicantID, schemeID, applicationID).Scan(&grants)
+		if err != nil {
+			return "", err
+		}
+		if grants >= *limits.MaxGrants {
+			return fmt.Sprintf("the applicant has already been granted this scheme %d time(s), the most allowed", grants), nil
+		}
+	}
+
+	if !reapplying {
+		return "", nil
+	}
+	cooldowns := []struct {
+		status string
+		days   *int
+	}{{"rejected", limits.RejectionCooldownDays}, {"approved", limits.GrantCooldownDays}}
+	for _, cooldown := range cooldowns {
+		if cooldown.days == nil {
+			continue
+		}
+		// Applications decided before decided_at was recorded fall back to their as_of date
+		var decidedAt sql.NullTime
+		err = tx.QueryRow(`
+			SELECT MAX(COALESCE(decided_at, as_of::timestamptz)) FROM applications
+			WHERE applicant_id = $1 AND scheme_id = $2 AND id <> $3 AND status = $4`,
+			applicantID, schemeID, applicationID, cooldown.status).Scan(&decidedAt)
+		if err != nil {
+			return "", err
+		}
+		if !decidedAt.Valid {
+			continue
+		}
+		reapplyFrom := decidedAt.Time.AddDate(0, 0, *cooldown.days)
+		if time.Now().Before(reapplyFrom) {
+			return fmt.Sprintf("the applicant was %s on %s and can apply again from %s", cooldown.status,
+				decidedAt.Time.Format(utils.DateLayout), reapplyFrom.Format(utils.DateLayout)), nil
+		}
+	}
+	return "", nil
+}
+
+// Whether an insert or update gave an applicant a second open application to a scheme
+// - The applications_open_index backs up checkApplicationLimits against concurrent requests
+func isOpenApplicationViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == "applications_open_index"
+}
+
+// Check an application against its scheme's limits, writing the error response if it breaks one
+func withinApplicationLimits(w http.ResponseWriter, tx *sql.Tx, applicationID string, reapplying bool) bool {
+	reason, err := checkApplicationLimits(tx, applicationID, reapplying)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking application limits: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, reason, http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -1,13 +1,17 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/neozhixuan/gt_assessment/database"
 	"github.com/neozhixuan/gt_assessment/models"
 	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
 
 	"github.com/google/uuid"
 )
@@ -16,7 +20,7 @@ import (
 func GetApplications(w http.ResponseWriter, r *http.Request) {
 	// Get list of applications
 	var applications []models.Application
-	rows, err := database.DB.Query("SELECT id, applicant_id, scheme_id, status FROM applications")
+	rows, err := database.DB.Query("SELECT id, applicant_id, scheme_id, status, as_of, scheme_version_id, decided_at, decided_by, assigned_to FROM applications")
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error fetching applications: %v", err), http.StatusInternalServerError)
 		return
@@ -26,14 +30,36 @@ func GetApplications(w http.ResponseWriter, r *http.Request) {
 	// Save each application into an object and append it to our list
 	for rows.Next() {
 		var application models.Application
-		err := rows.Scan(&application.ID, &application.ApplicantID, &application.SchemeID, &application.Status)
+		var asOf time.Time
+		var schemeVersionID, decidedAt sql.NullString
+		err := rows.Scan(&application.ID, &application.ApplicantID, &application.SchemeID, &application.Status, &asOf, &schemeVersionID,
+			&decidedAt, &application.DecidedBy, &application.AssignedTo)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error processing applications: %v", err), http.StatusInternalServerError)
 			return
 		}
+		application.AsOf = asOf.Format(utils.DateLayout)
+		application.SchemeVersionID = schemeVersionID.String
+		if decidedAt.Valid {
+			application.DecidedAt = &decidedAt.String
+		}
 		applications = append(applications, application)
 	}
 
+	// Attach the household members each application is for
+	applicationIDs := make([]string, len(applications))
+	for i, application := range applications {
+		applicationIDs[i] = application.ID
+	}
+	beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(database.DB, applicationIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching beneficiaries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i, application := range applications {
+		applications[i].Beneficiaries = beneficiariesByApplicationID[application.ID]
+	}
+
 	// Write our response using ResponseWriter
 	utils.SendJSONResponse(w, http.StatusOK, applications)
 }
@@ -49,14 +75,110 @@ func CreateApplication(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Eligibility is assessed as of the day of application, unless another date is given
+	if application.AsOf == "" {
+		application.AsOf = time.Now().Format(utils.DateLayout)
+	}
+	if _, err := time.Parse(utils.DateLayout, application.AsOf); err != nil {
+		http.Error(w, "as_of must be in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	// Applications can only be made while the scheme's window is open
+	window, err := fetchSchemeWindow(application.SchemeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !acceptsApplications(window, time.Now()) {
+		http.Error(w, "scheme is not accepting applications", http.StatusBadRequest)
+		return
+	}
+
+	// Pin the application to the version of the scheme in effect on the as_of date
+	application.SchemeVersionID, err = fetchSchemeVersionOn(application.SchemeID, application.AsOf)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme has no version in effect on the as_of date", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme version: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Start a transaction so that an approved application is saved together with its payments
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert into DB using SQL, with a unique UUID
 	application.ID = uuid.New().String()
-	_, err = database.DB.Exec("INSERT INTO applications (id, applicant_id, scheme_id, status) VALUES ($1, $2, $3, $4)",
-		application.ID, application.ApplicantID, application.SchemeID, application.Status)
+	user := utils.RequestUser(r)
+	_, err = tx.Exec(`INSERT INTO applications (id, applicant_id, scheme_id, status, as_of, scheme_version_id, decided_at, decided_by)
+		VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN $7 THEN NOW() END, CASE WHEN $7 THEN NULLIF($8, '') END)`,
+		application.ID, application.ApplicantID, application.SchemeID, application.Status, application.AsOf, application.SchemeVersionID,
+		utils.IsDecidedApplicationStatus(application.Status), user)
+	if isOpenApplicationViolation(err) {
+		http.Error(w, "the applicant already has an open application for this scheme", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error creating applications: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err = recordStatusChange(tx, application.ID, nil, application.Status, user, nil); err != nil {
+		http.Error(w, fmt.Sprintf("Error recording status history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The applicant must not already have an open application to the scheme, or be within a cooldown
+	if !withinApplicationLimits(w, tx, application.ID, true) {
+		return
+	}
+
+	if len(application.Beneficiaries) > 0 {
+		if !beneficiariesSaved(w, tx, application.ID, application.Beneficiaries) {
+			return
+		}
+		beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(tx, []string{application.ID})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching beneficiaries: %v", err), http.StatusInternalServerError)
+			return
+		}
+		application.Beneficiaries = beneficiariesByApplicationID[application.ID]
+	}
+
+	// A new application has no documents yet, so it can only start under review or approved if its scheme requires none
+	if (application.Status == "under_review" || application.Status == "approved") && !documentsVerified(w, tx, application.ID) {
+		return
+	}
+
+	if application.Status == "approved" {
+		if !approveWithinGroups(w, tx, application.ID) {
+			return
+		}
+		if err = generateDisbursements(tx, application.ID); err != nil {
+			http.Error(w, fmt.Sprintf("Error scheduling disbursements: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = webhooks.Enqueue(tx, webhooks.ApplicationCreated, application); err != nil {
+		http.Error(w, fmt.Sprintf("Error recording event: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	// Write our response using ResponseWriter
 	utils.SendJSONResponse(w, http.StatusOK, application)
@@ -70,13 +192,21 @@ func DeleteApplication(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Note where its attachments are kept, as their rows go with it
+	keys, err := fetchAttachmentKeys(`WHERE application_id = $1`, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete application from DB
 	query := `DELETE FROM applications WHERE id = $1`
-	_, err := database.DB.Exec(query, applicationID)
+	_, err = database.DB.Exec(query, applicationID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting applications: %v", err), http.StatusInternalServerError)
 		return
 	}
+	deleteBlobs(keys)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Application deleted successfully"))
@@ -99,6 +229,7 @@ func UpdateApplication(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Build update query dynamically based on non-empty fields
+	user := utils.RequestUser(r)
 	query := "UPDATE applications SET "
 	values := []interface{}{}
 	counter := 1
@@ -110,6 +241,21 @@ func UpdateApplication(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if application.SchemeID != "" {
+		// Moving an application to another scheme is like applying to it, so its window must be open
+		window, err := fetchSchemeWindow(application.SchemeID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "scheme not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !acceptsApplications(window, time.Now()) {
+			http.Error(w, "scheme is not accepting applications", http.StatusBadRequest)
+			return
+		}
+
 		query += "scheme_id = $" + fmt.Sprint(counter) + ", "
 		values = append(values, application.SchemeID)
 		counter++
@@ -119,21 +265,213 @@ func UpdateApplication(w http.ResponseWriter, r *http.Request) {
 		query += "status = $" + fmt.Sprint(counter) + ", "
 		values = append(values, application.Status)
 		counter++
+
+		// Record when and by whom the application is decided, and clear them if the application is reopened
+		if utils.IsDecidedApplicationStatus(application.Status) {
+			query += "decided_at = CASE WHEN status = $" + fmt.Sprint(counter-1) + " THEN decided_at ELSE NOW() END, "
+			query += "decided_by = CASE WHEN status = $" + fmt.Sprint(counter-1) + " THEN decided_by ELSE NULLIF($" + fmt.Sprint(counter) + ", '') END, "
+			values = append(values, user)
+			counter++
+		} else {
+			query += "decided_at = NULL, decided_by = NULL, "
+		}
+	}
+
+	if application.AsOf != "" {
+		if _, err := time.Parse(utils.DateLayout, application.AsOf); err != nil {
+			http.Error(w, "as_of must be in YYYY-MM-DD format", http.StatusBadRequest)
+			return
+		}
+		query += "as_of = $" + fmt.Sprint(counter) + ", "
+		values = append(values, application.AsOf)
+		counter++
 	}
 
-	// Remove trailing comma and space
-	query = query[:len(query)-2]
+	// Moving the application to another scheme or applicant is applying again, so the cooldowns apply
+	reapplying := application.SchemeID != "" || application.ApplicantID != ""
 
-	// Add WHERE clause
-	query += " WHERE id = $" + fmt.Sprint(counter)
-	values = append(values, applicationID)
+	// Moving the application to another scheme or date re-pins it to the version in effect then
+	if application.SchemeID != "" || application.AsOf != "" {
+		var currentSchemeID string
+		var currentAsOf time.Time
+		err := database.DB.QueryRow(`SELECT scheme_id, as_of FROM applications WHERE id = $1`, applicationID).
+			Scan(&currentSchemeID, &currentAsOf)
+		if err == sql.ErrNoRows {
+			http.Error(w, "application not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if application.SchemeID == "" {
+			application.SchemeID = currentSchemeID
+		}
+		if application.AsOf == "" {
+			application.AsOf = currentAsOf.Format(utils.DateLayout)
+		}
+
+		schemeVersionID, err := fetchSchemeVersionOn(application.SchemeID, application.AsOf)
+		if err == sql.ErrNoRows {
+			http.Error(w, "scheme has no version in effect on the as_of date", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching scheme version: %v", err), http.StatusInternalServerError)
+			return
+		}
+		query += "scheme_version_id = $" + fmt.Sprint(counter) + ", "
+		values = append(values, schemeVersionID)
+		counter++
+	}
 
-	// Execute the query
-	_, err := database.DB.Exec(query, values...)
+	// Start a transaction so that the payments change together with the status
+	tx, err := database.DB.Begin()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update application: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the application and note its status, for the status history
+	var previousStatus string
+	err = tx.QueryRow(`SELECT status FROM applications WHERE id = $1 FOR UPDATE`, applicationID).Scan(&previousStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the query, unless only the beneficiaries are being changed
+	if len(values) > 0 {
+		// Remove trailing comma and space
+		query = query[:len(query)-2]
+
+		// Add WHERE clause
+		query += " WHERE id = $" + fmt.Sprint(counter)
+		values = append(values, applicationID)
+
+		_, err = tx.Exec(query, values...)
+		if isOpenApplicationViolation(err) {
+			http.Error(w, "the applicant already has an open application for this scheme", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update application: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if application.Status != "" {
+		if err = recordStatusChange(tx, applicationID, &previousStatus, application.Status, user, nil); err != nil {
+			http.Error(w, fmt.Sprintf("Error recording status history: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// An application can only be taken up for review or approved once its scheme's required documents are verified
+	if (application.Status == "under_review" || application.Status == "approved") && !documentsVerified(w, tx, applicationID) {
+		return
+	}
+
+	// Replace the beneficiaries if given, otherwise check the current ones still fit a new applicant, scheme or version
+	if application.Beneficiaries != nil || reapplying || application.AsOf != "" {
+		beneficiaries := application.Beneficiaries
+		if beneficiaries == nil {
+			beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(tx, []string{applicationID})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error fetching beneficiaries: %v", err), http.StatusInternalServerError)
+				return
+			}
+			beneficiaries = beneficiariesByApplicationID[applicationID]
+		} else {
+			// Payments already scheduled are for the current beneficiaries
+			var scheduled bool
+			err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM disbursements WHERE application_id = $1 AND status <> 'cancelled')`,
+				applicationID).Scan(&scheduled)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error fetching disbursements: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if scheduled {
+				http.Error(w, "beneficiaries cannot be changed once payments are scheduled", http.StatusConflict)
+				return
+			}
+		}
+		if !beneficiariesSaved(w, tx, applicationID, beneficiaries) {
+			return
+		}
+	}
+
+	if !withinApplicationLimits(w, tx, applicationID, reapplying) {
+		return
+	}
+
+	// Approving schedules the payments, and moving away from approved cancels the ones not yet made
+	if application.Status == "approved" {
+		if !approveWithinGroups(w, tx, applicationID) {
+			return
+		}
+		err = generateDisbursements(tx, applicationID)
+	} else if application.Status != "" {
+		err = cancelDisbursements(tx, applicationID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating disbursements: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Application updated successfully"))
 }
+
+// GET request to check whether an application's applicant was eligible for its scheme on the application's as_of date
+func GetApplicationEligibility(w http.ResponseWriter, r *http.Request) {
+	applicationID := r.URL.Query().Get("application")
+	if applicationID == "" {
+		http.Error(w, "application ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Fetch the application
+	result := models.ApplicationEligibility{ApplicationID: applicationID}
+	var asOf time.Time
+	err := database.DB.QueryRow(`SELECT applicant_id, scheme_id, as_of FROM applications WHERE id = $1`, applicationID).
+		Scan(&result.ApplicantID, &result.SchemeID, &asOf)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result.AsOf = asOf.Format(utils.DateLayout)
+
+	// Evaluate eligibility as it was on the as_of date, for the household members the application is for
+	beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(database.DB, []string{applicationID})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching beneficiaries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// - A beneficiary who has since left the household leaves the application ineligible
+	schemes, err := fetchEligibleSchemes(result.ApplicantID, asOf, beneficiaryIDs(beneficiariesByApplicationID[applicationID]))
+	if err != nil && !errors.Is(err, errNotInHousehold) {
+		http.Error(w, fmt.Sprintf("Error fetching eligible schemes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, scheme := range schemes {
+		if scheme.ID == result.SchemeID {
+			result.Eligible = true
+			break
+		}
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, result)
+}
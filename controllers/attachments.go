@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/storage"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// The largest file that can be attached to an application
+const maxAttachmentBytes = 10 << 20
+
+// The kinds of file that can be attached, worked out from their contents rather than what the client says
+var attachmentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+// GET request for the files attached to an application, oldest first
+func GetAttachments(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	attachments, err := fetchAttachments(`WHERE application_id = $1`, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, attachments)
+}
+
+// POST request to attach a file to an application, sent as the "file" field of a multipart form
+// - The X-User header records who uploaded it
+func UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	// Leave some room for the rest of the form, and check the file itself as it is stored
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	var file io.Reader
+	var fileName string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			file, fileName = part, filepath.Base(part.FileName())
+			break
+		}
+	}
+	if file == nil || fileName == "." || fileName == string(filepath.Separator) {
+		http.Error(w, "a file with a name is required", http.StatusBadRequest)
+		return
+	}
+	if len(fileName) > 255 {
+		http.Error(w, "file names cannot be longer than 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	// Sniff the type from the start of the file
+	buffered := bufio.NewReaderSize(file, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(head) == 0 {
+		http.Error(w, "file is empty", http.StatusBadRequest)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !attachmentTypes[contentType] {
+		http.Error(w, fmt.Sprintf("files of type %s cannot be attached, only PDFs, JPEGs and PNGs", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Store the file while working out its size and checksum, reading one byte past the limit to tell if it is too big
+	attachment := models.Attachment{
+		ID:            uuid.New().String(),
+		ApplicationID: applicationID,
+		FileName:      fileName,
+		ContentType:   contentType,
+	}
+	key := attachmentKey(applicationID, attachment.ID)
+	hash := sha256.New()
+	size := &byteCounter{}
+	err = storage.Blobs.Put(key, io.TeeReader(io.LimitReader(buffered, maxAttachmentBytes+1), io.MultiWriter(hash, size)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || size.n > maxAttachmentBytes {
+		deleteBlobs([]string{key})
+		http.Error(w, fmt.Sprintf("files cannot be larger than %d bytes", maxAttachmentBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	attachment.SizeBytes = size.n
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	user := utils.RequestUser(r)
+	err = database.DB.QueryRow(`
+		INSERT INTO application_attachments (id, application_id, file_name, content_type, size_bytes, sha256, storage_key, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
+		RETURNING uploaded_by, uploaded_at`,
+		attachment.ID, attachment.ApplicationID, attachment.FileName, attachment.ContentType, attachment.SizeBytes,
+		attachment.SHA256, key, user).Scan(&attachment.UploadedBy, &attachment.UploadedAt)
+	if err != nil {
+		deleteBlobs([]string{key})
+		http.Error(w, fmt.Sprintf("Error saving attachment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, attachment)
+}
+
+// GET request to download a file attached to an application
+// - The X-Checksum-SHA256 header carries the checksum taken when it was uploaded
+func DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var attachment models.Attachment
+	var key string
+	err := database.DB.QueryRow(`
+		SELECT file_name, content_type, size_bytes, sha256, storage_key FROM application_attachments
+		WHERE id::text = $1 AND application_id::text = $2`, vars["attachmentID"], vars["id"]).
+		Scan(&attachment.FileName, &attachment.ContentType, &attachment.SizeBytes, &attachment.SHA256, &key)
+	if err == sql.ErrNoRows {
+		http.Error(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching attachment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	blob, err := storage.Blobs.Open(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "attachment file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening attachment: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.SizeBytes, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Checksum-SHA256", attachment.SHA256)
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, blob); err != nil {
+		log.Printf("Error sending attachment %s: %v", key, err)
+	}
+}
+
+// Where an attachment's file is kept in the blob store
+func attachmentKey(applicationID, attachmentID string) string {
+	return "applications/" + applicationID + "/" + attachmentID
+}
+
+// Fetch the blob store keys of the attachments matching a WHERE clause, so they can be removed with their rows
+func fetchAttachmentKeys(where string, args ...interface{}) ([]string, error) {
+	rows, err := database.DB.Query(`SELECT storage_key FROM application_attachments `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Remove files from the blob store
+// - Failures are only logged, as the rows pointing at the files have already gone
+func deleteBlobs(keys []string) {
+	for _, key := range keys {
+		if err := storage.Blobs.Delete(key); err != nil {
+			log.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+// Fetch attachments matching a WHERE clause, oldest first
+func fetchAttachments(where string, args ...interface{}) ([]models.Attachment, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, application_id, file_name, content_type, size_bytes, sha256, uploaded_by, uploaded_at
+		FROM application_attachments `+where+`
+		ORDER BY uploaded_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []models.Attachment{}
+	for rows.Next() {
+		var attachment models.Attachment
+		err := rows.Scan(&attachment.ID, &attachment.ApplicationID, &attachment.FileName, &attachment.ContentType,
+			&attachment.SizeBytes, &attachment.SHA256, &attachment.UploadedBy, &attachment.UploadedAt)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// Counts the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/models"
+)
+
+// Runs queries on the database or within a transaction
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// How relations.id2 is related to relations.id1 when read the other way round, e.g. a child's parent
+const invertedRelation = `CASE relations.relation WHEN 'child' THEN 'parent' WHEN 'parent' THEN 'child' ELSE relations.relation END`
+
+// Returned when a beneficiary is not related to the applicant
+var errNotInHousehold = errors.New("is not a member of the applicant's household")
+
+// Fetch the IDs of the applicant's household members
+// - Relations may be stored in either direction
+func fetchHouseholdMemberIDs(q queryer, applicantID string) (map[string]bool, error) {
+	rows, err := q.Query(`
+		SELECT id2 FROM relations WHERE id1 = $1
+		UNION SELECT id1 FROM relations WHERE id2 = $1`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]bool)
+	for rows.Next() {
+		var memberID string
+		if err := rows.Scan(&memberID); err != nil {
+			return nil, err
+		}
+		members[memberID] = true
+	}
+	return members, rows.Err()
+}
+
+// Fetch the beneficiaries of each application, with how they are related to its applicant
+// - Applications made for the whole household have none
+// - Relations may be stored in either direction, and are inverted when stored from the beneficiary's side
+func fetchBeneficiariesByApplicationID(q queryer, applicationIDs []string) (map[string][]models.ApplicationBeneficiary, error) {
+	beneficiariesByApplicationID := make(map[string][]models.ApplicationBeneficiary)
+	if len(applicationIDs) == 0 {
+		return beneficiariesByApplicationID, nil
+	}
+
+	rows, err := q.Query(`
+		SELECT application_beneficiaries.application_id, application_beneficiaries.applicant_id,
+			COALESCE((
+				SELECT CASE WHEN relations.id1 = applications.applicant_id THEN relations.relation ELSE `+invertedRelation+` END
+				FROM relations
+				WHERE (relations.id1 = applications.applicant_id AND relations.id2 = application_beneficiaries.applicant_id)
+					OR (relations.id1 = application_beneficiaries.applicant_id AND relations.id2 = applications.applicant_id)
+				ORDER BY relations.id1 = applications.applicant_id DESC
+				LIMIT 1
+			), ''), application_beneficiaries.benefit_ids
+		FROM application_beneficiaries
+		JOIN applications ON applications.id = application_beneficiaries.application_id
+		WHERE application_beneficiaries.application_id = ANY($1::uuid[])
+		ORDER BY application_beneficiaries.applicant_id`, pq.Array(applicationIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var applicationID string
+		var beneficiary models.ApplicationBeneficiary
+		var benefitIDs pq.StringArray
+		if err := rows.Scan(&applicationID, &beneficiary.ApplicantID, &beneficiary.Relation, &benefitIDs); err != nil {
+			return nil, err
+		}
+		beneficiary.BenefitIDs = benefitIDs
+		beneficiariesByApplicationID[applicationID] = append(beneficiariesByApplicationID[applicationID], beneficiary)
+	}
+	return beneficiariesByApplicationID, rows.Err()
+}
+
+// The IDs of an application's beneficiaries, or nil if it is for the whole household
+func beneficiaryIDs(beneficiaries []models.ApplicationBeneficiary) []string {
+	if len(beneficiaries) == 0 {
+		return nil
+	}
+	ids := make([]string, len(beneficiaries))
+	for i, beneficiary := range beneficiaries {
+		ids[i] = beneficiary.ApplicantID
+	}
+	return ids
+}
+
+// Replace the beneficiaries of an application that has been saved in the transaction
+// - Each beneficiary must be related to the applicant, and can only be listed once
+// - Each benefit must be offered by the application's scheme version, and can only be paid for one beneficiary
+// - Returns why the beneficiaries are invalid, or "" if they were saved
+func saveBeneficiaries(tx *sql.Tx, applicationID string, beneficiaries []models.ApplicationBeneficiary) (string, error) {
+	var applicantID string
+	var versionID sql.NullString
+	err := tx.QueryRow(`SELECT applicant_id, scheme_version_id FROM applications WHERE id = $1`, applicationID).
+		Scan(&applicantID, &versionID)
+	if err != nil {
+		return "", err
+	}
+
+	// The benefits of the scheme version the application is pinned to
+	offered := make(map[string]bool)
+	rows, err := tx.Query(`SELECT benefit_id FROM scheme_version_benefits WHERE version_id = $1`, versionID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var benefitID string
+		if err := rows.Scan(&benefitID); err != nil {
+			return "", err
+		}
+		offered[benefitID] = true
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	listed := make(map[string]bool)
+	paidFor := make(map[string]string)
+	for _, beneficiary := range beneficiaries {
+		if beneficiary.ApplicantID == applicantID {
+			return "the applicant cannot be their own beneficiary", nil
+		}
+		if listed[beneficiary.ApplicantID] {
+			return fmt.Sprintf("beneficiary %s is listed more than once", beneficiary.ApplicantID), nil
+		}
+		listed[beneficiary.ApplicantID] = true
+
+		// Relations may be stored in either direction
+		var related bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM relations
+				WHERE (id1 = $1 AND id2::text = $2) OR (id1::text = $2 AND id2 = $1)
+			)`, applicantID, beneficiary.ApplicantID).Scan(&related)
+		if err != nil {
+			return "", err
+		}
+		if !related {
+			return fmt.Sprintf("beneficiary %s is not a member of the applicant's household", beneficiary.ApplicantID), nil
+		}
+
+		for _, benefitID := range beneficiary.BenefitIDs {
+			if !offered[benefitID] {
+				return fmt.Sprintf("benefit %s is not offered by the application's scheme", benefitID), nil
+			}
+			if other, ok := paidFor[benefitID]; ok {
+				return fmt.Sprintf("benefit %s is already paid for beneficiary %s", benefitID, other), nil
+			}
+			paidFor[benefitID] = beneficiary.ApplicantID
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM application_beneficiaries WHERE application_id = $1`, applicationID)
+	if err != nil {
+		return "", err
+	}
+	for _, beneficiary := range beneficiaries {
+		if beneficiary.BenefitIDs == nil {
+			beneficiary.BenefitIDs = []string{}
+		}
+		_, err = tx.Exec(`INSERT INTO application_beneficiaries (application_id, applicant_id, benefit_ids) VALUES ($1, $2, $3)`,
+			applicationID, beneficiary.ApplicantID, pq.Array(beneficiary.BenefitIDs))
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// Save an application's beneficiaries, writing the error response if they are invalid
+func beneficiariesSaved(w http.ResponseWriter, tx *sql.Tx, applicationID string, beneficiaries []models.ApplicationBeneficiary) bool {
+	reason, err := saveBeneficiaries(tx, applicationID, beneficiaries)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving beneficiaries: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
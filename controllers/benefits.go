@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// The columns of a benefit row, in the order scanBenefit reads them
+const benefitColumns = `benefits.id, benefits.name, benefits.amount, benefits.currency, benefits.type, benefits.frequency, benefits.duration,
+	benefits.per_child_amount, benefits.per_household_member_amount, benefits.max_amount, benefits.retired_at`
+
+// Adds a benefit to the catalogue
+const insertBenefitQuery = `
+	INSERT INTO benefits (id, name, amount, currency, type, frequency, duration, per_child_amount, per_household_member_amount, max_amount)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+// A scheme referred to a catalogue benefit by ID, but gave it different fields
+var errBenefitConflict = errors.New("conflicts with the catalogue")
+
+// A scheme referred to a catalogue benefit that has been retired
+var errBenefitRetired = errors.New("is retired")
+
+// GET request for the benefit catalogue
+// - Retired benefits are left out unless ?include_retired=true
+func GetBenefits(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + benefitColumns + ` FROM benefits`
+	if r.URL.Query().Get("include_retired") != "true" {
+		query += ` WHERE retired_at IS NULL`
+	}
+	query += ` ORDER BY name`
+
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching benefits: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	benefits := []models.Benefit{}
+	for rows.Next() {
+		benefit, err := scanBenefit(rows)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning benefit: %v", err), http.StatusInternalServerError)
+			return
+		}
+		benefits = append(benefits, benefit)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating benefits: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, benefits)
+}
+
+// POST request to add a benefit to the catalogue
+func CreateBenefit(w http.ResponseWriter, r *http.Request) {
+	var benefit models.Benefit
+	if err := json.NewDecoder(r.Body).Decode(&benefit); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateBenefit(&benefit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	benefit.ID = uuid.New().String()
+	benefit.RetiredAt = nil
+	_, err := database.DB.Exec(insertBenefitQuery, benefit.ID, benefit.Name, benefit.Amount, benefit.Currency, benefit.Type, benefit.Frequency,
+		benefit.Duration, benefit.PerChildAmount, benefit.PerHouseholdMemberAmount, benefit.MaxAmount)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating benefit: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, benefit)
+}
+
+// PUT request to change a benefit in the catalogue
+// - Every scheme the benefit is linked to sees the change
+// - Applications must keep being paid what they applied for, so a benefit offered by a version with applications cannot be changed
+func UpdateBenefit(w http.ResponseWriter, r *http.Request) {
+	benefitID := mux.Vars(r)["id"]
+
+	var update models.BenefitUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	benefit, err := fetchBenefit(benefitID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "benefit not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching benefit: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Apply the fields that were given, then check the result as a whole
+	// - A tier amount or cap of 0 removes it
+	if update.Name != "" {
+		benefit.Name = update.Name
+	}
+	if update.Type != "" {
+		benefit.Type = update.Type
+	}
+	if update.Amount != nil {
+		benefit.Amount = *update.Amount
+	}
+	if update.Currency != "" {
+		benefit.Currency = update.Currency
+	}
+	if update.Frequency != "" {
+		benefit.Frequency = update.Frequency
+	}
+	if update.Duration != 0 {
+		benefit.Duration = update.Duration
+	}
+	if update.PerChildAmount != nil {
+		benefit.PerChildAmount = nilIfZero(update.PerChildAmount)
+	}
+	if update.PerHouseholdMemberAmount != nil {
+		benefit.PerHouseholdMemberAmount = nilIfZero(update.PerHouseholdMemberAmount)
+	}
+	if update.MaxAmount != nil {
+		benefit.MaxAmount = nilIfZero(update.MaxAmount)
+	}
+	if err := validateBenefit(&benefit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the benefit so no version can be linked to it while we check
+	if _, err = tx.Exec(`SELECT id FROM benefits WHERE id = $1 FOR UPDATE`, benefitID); err != nil {
+		http.Error(w, fmt.Sprintf("Error locking benefit: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var pinned bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM scheme_version_benefits
+			JOIN applications ON applications.scheme_version_id = scheme_version_benefits.version_id
+			WHERE scheme_version_benefits.benefit_id = $1
+		)`, benefitID).Scan(&pinned)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if pinned {
+		http.Error(w, "applications have been made under scheme versions offering this benefit, add a new benefit and publish new versions offering it instead",
+			http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE benefits SET name = $1, amount = $2, currency = $3, type = $4, frequency = $5, duration = $6,
+			per_child_amount = $7, per_household_member_amount = $8, max_amount = $9
+		WHERE id = $10`,
+		benefit.Name, benefit.Amount, benefit.Currency, benefit.Type, benefit.Frequency, benefit.Duration,
+		benefit.PerChildAmount, benefit.PerHouseholdMemberAmount, benefit.MaxAmount, benefitID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating benefit: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, benefit)
+}
+
+// POST request to retire a benefit
+// - Schemes that already offer it keep it, but it cannot be added to schemes from now on
+func RetireBenefit(w http.ResponseWriter, r *http.Request) {
+	benefitID := mux.Vars(r)["id"]
+
+	result, err := database.DB.Exec(`UPDATE benefits SET retired_at = NOW() WHERE id = $1 AND retired_at IS NULL`, benefitID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retiring benefit: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		// Tell apart a missing benefit from one that was already retired
+		if _, err := fetchBenefit(benefitID); err == sql.ErrNoRows {
+			http.Error(w, "benefit not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "benefit is already retired", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Benefit retired successfully"))
+}
+
+// Check a benefit's fields, defaulting it to a single cash payment
+func validateBenefit(benefit *models.Benefit) error {
+	if benefit.Name == "" {
+		return errors.New("benefit name is required")
+	}
+	if benefit.Type == "" {
+		benefit.Type = "cash"
+	}
+	if !utils.IsValidBenefitType(benefit.Type) {
+		return fmt.Errorf("benefit type must be one of cash, voucher, in_kind or subsidy_percentage")
+	}
+	if benefit.Frequency == "" {
+		benefit.Frequency = "one_off"
+	}
+	if !utils.IsValidBenefitFrequency(benefit.Frequency) {
+		return fmt.Errorf("benefit frequency must be one of one_off, monthly or quarterly")
+	}
+	if benefit.Duration == 0 {
+		benefit.Duration = 1
+	}
+	if benefit.Duration < 1 {
+		return errors.New("benefit duration must be at least 1 payment")
+	}
+	if benefit.Frequency == "one_off" && benefit.Duration != 1 {
+		return errors.New("a one-off benefit is paid once, so its duration must be 1")
+	}
+
+	for _, amount := range []*models.Money{&benefit.Amount, benefit.PerChildAmount, benefit.PerHouseholdMemberAmount, benefit.MaxAmount} {
+		if amount != nil && *amount < 0 {
+			return errors.New("benefit amounts cannot be negative")
+		}
+	}
+	if benefit.Currency == "" {
+		benefit.Currency = models.DefaultCurrency
+	}
+	if !utils.IsValidCurrencyCode(benefit.Currency) {
+		return errors.New("benefit currency must be a 3 letter ISO 4217 code, e.g. SGD")
+	}
+	if benefit.Type == "subsidy_percentage" && benefit.Amount > models.Money(100*100) { // 100%, held in hundredths like cents
+		return errors.New("a subsidy percentage cannot be more than 100")
+	}
+	return nil
+}
+
+// Treat a zero amount as no amount
+func nilIfZero(amount *models.Money) *models.Money {
+	if amount == nil || *amount == 0 {
+		return nil
+	}
+	return amount
+}
+
+// Check the benefits a scheme refers to
+// - A benefit with the ID of a catalogue benefit refers to it, and must not be retired, which catalogueBenefit checks in the transaction
+// - Any fields given with it must match the catalogue, as they would otherwise be ignored (errBenefitConflict)
+// - Any other benefit is added to the catalogue, so it needs all its fields
+func validateSchemeBenefits(benefits []models.Benefit) error {
+	for i := range benefits {
+		if benefits[i].ID != "" {
+			existing, err := fetchBenefit(benefits[i].ID)
+			if err == nil {
+				if benefitDiffers(benefits[i], existing) {
+					return fmt.Errorf("benefit %s (%s) %w, change it through PUT /api/benefits/{id} or leave out its id to add a new benefit",
+						existing.ID, existing.Name, errBenefitConflict)
+				}
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+		if err := validateBenefit(&benefits[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The status to send for a scheme whose benefits failed validation
+func schemeBenefitsStatus(err error) int {
+	if errors.Is(err, errBenefitConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// Whether a benefit given with a scheme sets any field differently from its catalogue entry
+// - Fields left empty are not compared, so a benefit can be referred to by its ID alone
+func benefitDiffers(given, stored models.Benefit) bool {
+	return (given.Name != "" && given.Name != stored.Name) ||
+		(given.Amount != 0 && given.Amount != stored.Amount) ||
+		(given.Currency != "" && given.Currency != stored.Currency) ||
+		(given.Type != "" && given.Type != stored.Type) ||
+		(given.Frequency != "" && given.Frequency != stored.Frequency) ||
+		(given.Duration != 0 && given.Duration != stored.Duration) ||
+		optionalAmountDiffers(given.PerChildAmount, stored.PerChildAmount) ||
+		optionalAmountDiffers(given.PerHouseholdMemberAmount, stored.PerHouseholdMemberAmount) ||
+		optionalAmountDiffers(given.MaxAmount, stored.MaxAmount)
+}
+
+// Whether an optional amount was given and differs from the stored one, treating 0 as no amount
+func optionalAmountDiffers(given, stored *models.Money) bool {
+	if given == nil {
+		return false
+	}
+	given, stored = nilIfZero(given), nilIfZero(stored)
+	if given == nil || stored == nil {
+		return given != stored
+	}
+	return *given != *stored
+}
+
+// Return the catalogue ID of a benefit a scheme refers to, adding it to the catalogue if it is new
+// - Benefits already in the catalogue are linked as they are, unless they are retired (errBenefitRetired)
+// - The benefit is locked so that it cannot be retired before the transaction commits
+func catalogueBenefit(tx *sql.Tx, benefit models.Benefit) (string, error) {
+	if benefit.ID != "" {
+		var retired bool
+		err := tx.QueryRow(`SELECT retired_at IS NOT NULL FROM benefits WHERE id = $1 FOR SHARE`, benefit.ID).Scan(&retired)
+		if err == nil && retired {
+			return "", fmt.Errorf("benefit %s %w", benefit.ID, errBenefitRetired)
+		}
+		if err == nil {
+			return benefit.ID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	} else {
+		benefit.ID = uuid.New().String()
+	}
+	_, err := tx.Exec(insertBenefitQuery, benefit.ID, benefit.Name, benefit.Amount, benefit.Currency, benefit.Type, benefit.Frequency,
+		benefit.Duration, benefit.PerChildAmount, benefit.PerHouseholdMemberAmount, benefit.MaxAmount)
+	return benefit.ID, err
+}
+
+// Fetch a single benefit from the catalogue
+func fetchBenefit(benefitID string) (models.Benefit, error) {
+	rows, err := database.DB.Query(`SELECT `+benefitColumns+` FROM benefits WHERE id = $1`, benefitID)
+	if err != nil {
+		return models.Benefit{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return models.Benefit{}, err
+		}
+		return models.Benefit{}, sql.ErrNoRows
+	}
+	return scanBenefit(rows)
+}
+
+// Scan a row of benefitColumns, after any leading columns
+func scanBenefit(rows *sql.Rows, leading ...interface{}) (models.Benefit, error) {
+	var benefit models.Benefit
+	var retiredAt sql.NullString
+	dest := append(leading, &benefit.ID, &benefit.Name, &benefit.Amount, &benefit.Currency, &benefit.Type, &benefit.Frequency,
+		&benefit.Duration, &benefit.PerChildAmount, &benefit.PerHouseholdMemberAmount, &benefit.MaxAmount, &retiredAt)
+	if err := rows.Scan(dest...); err != nil {
+		return benefit, err
+	}
+	if retiredAt.Valid {
+		benefit.RetiredAt = &retiredAt.String
+	}
+	return benefit, nil
+}
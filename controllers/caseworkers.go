@@ -0,0 +1,420 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// Ways of picking the caseworker to assign an application to
+// - round_robin picks whoever was assigned an application longest ago
+// - least_loaded picks whoever has the fewest undecided applications
+var assignmentStrategies = map[string]bool{"round_robin": true, "least_loaded": true}
+
+// Query counting the undecided applications assigned to each caseworker, given the parameter holding the decided statuses
+func openApplicationsQuery(param int) string {
+	return fmt.Sprintf(`SELECT COUNT(*) FROM applications
+		WHERE applications.assigned_to = caseworkers.id AND applications.status <> ALL($%d::text[])`, param)
+}
+
+// GET request for every caseworker, with how many undecided applications they have
+func GetCaseworkers(w http.ResponseWriter, r *http.Request) {
+	caseworkers, err := fetchCaseworkers(`TRUE`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching caseworkers: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, caseworkers)
+}
+
+// POST request to add a caseworker
+func CreateCaseworker(w http.ResponseWriter, r *http.Request) {
+	var caseworker models.Caseworker
+	if err := json.NewDecoder(r.Body).Decode(&caseworker); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if caseworker.Name == "" {
+		http.Error(w, "caseworker name is required", http.StatusBadRequest)
+		return
+	}
+	caseworker.ID = uuid.New().String()
+	caseworker.Active = true
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO caseworkers (id, name) VALUES ($1, $2)`, caseworker.ID, caseworker.Name)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "a caseworker with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating caseworker: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !caseworkerSchemesSaved(w, tx, caseworker.ID, caseworker.SchemeIDs) {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondWithCaseworker(w, caseworker.ID, http.StatusCreated)
+}
+
+// PUT request to rename a caseworker, change their schemes, or deactivate them
+// - A deactivated caseworker keeps the applications they have, but is not assigned any more
+func UpdateCaseworker(w http.ResponseWriter, r *http.Request) {
+	caseworkerID := mux.Vars(r)["id"]
+
+	var update models.CaseworkerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE caseworkers SET name = COALESCE(NULLIF($1, ''), name), active = COALESCE($2, active)
+		WHERE id = $3`, update.Name, update.Active, caseworkerID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "a caseworker with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating caseworker: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		http.Error(w, "caseworker not found", http.StatusNotFound)
+		return
+	}
+	if update.SchemeIDs != nil && !caseworkerSchemesSaved(w, tx, caseworkerID, *update.SchemeIDs) {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondWithCaseworker(w, caseworkerID, http.StatusOK)
+}
+
+// POST request to assign an application to a caseworker
+// - Names the caseworker, or a strategy to pick one from those who handle the application's scheme
+func AssignApplication(w http.ResponseWriter, r *http.Request) {
+	applicationID := r.URL.Query().Get("application")
+	if applicationID == "" {
+		http.Error(w, "application ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var assignment models.Assignment
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if (assignment.CaseworkerID == "") == (assignment.Strategy == "") {
+		http.Error(w, "either caseworker_id or strategy is required", http.StatusBadRequest)
+		return
+	}
+	if assignment.Strategy != "" && !assignmentStrategies[assignment.Strategy] {
+		http.Error(w, "strategy must be round_robin or least_loaded", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var schemeID string
+	err = tx.QueryRow(`SELECT scheme_id FROM applications WHERE id = $1 FOR UPDATE`, applicationID).Scan(&schemeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	caseworkerID, err := pickCaseworker(tx, schemeID, assignment)
+	if err == errNoCaseworker {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error picking caseworker: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err = assignApplication(tx, applicationID, caseworkerID); err != nil {
+		http.Error(w, fmt.Sprintf("Error assigning application: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusOK, models.AssignmentResult{ApplicationID: applicationID, CaseworkerID: caseworkerID})
+}
+
+// POST request to assign every unassigned, undecided application using a strategy, oldest first
+// - Applications whose scheme no active caseworker handles are left unassigned
+func AutoAssignApplications(w http.ResponseWriter, r *http.Request) {
+	var assignment models.Assignment
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !assignmentStrategies[assignment.Strategy] {
+		http.Error(w, "strategy must be round_robin or least_loaded", http.StatusBadRequest)
+		return
+	}
+	assignment.CaseworkerID = ""
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	queue, err := fetchQueue(tx, `applications.assigned_to IS NULL AND applications.status <> ALL($1::text[])`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching unassigned applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	results := []models.AssignmentResult{}
+	for _, application := range queue {
+		caseworkerID, err := pickCaseworker(tx, application.SchemeID, assignment)
+		if err == errNoCaseworker {
+			continue
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error picking caseworker: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err = assignApplication(tx, application.ID, caseworkerID); err != nil {
+			http.Error(w, fmt.Sprintf("Error assigning application: %v", err), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, models.AssignmentResult{ApplicationID: application.ID, CaseworkerID: caseworkerID})
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusOK, results)
+}
+
+// GET request for the undecided applications assigned to the caseworker named in the X-User header
+func GetMyQueue(w http.ResponseWriter, r *http.Request) {
+	user := utils.RequestUser(r)
+	if user == "" {
+		http.Error(w, "the X-User header is required", http.StatusBadRequest)
+		return
+	}
+	sendQueue(w, `applications.status <> ALL($1::text[])
+		AND applications.assigned_to = (SELECT id FROM caseworkers WHERE name = $2)`, user)
+}
+
+// GET request for the undecided applications that no caseworker has
+func GetUnassignedQueue(w http.ResponseWriter, r *http.Request) {
+	sendQueue(w, `applications.status <> ALL($1::text[]) AND applications.assigned_to IS NULL`)
+}
+
+// GET request for the undecided applications that are past their scheme's SLA
+func GetOverdueQueue(w http.ResponseWriter, r *http.Request) {
+	sendQueue(w, `applications.status <> ALL($1::text[]) AND schemes.sla_days IS NOT NULL
+		AND NOW() > submitted.at + schemes.sla_days * INTERVAL '1 day'`)
+}
+
+// Respond with the applications in a queue
+func sendQueue(w http.ResponseWriter, condition string, args ...interface{}) {
+	queue, err := fetchQueue(database.DB, condition, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching queue: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusOK, queue)
+}
+
+// Fetch the applications matching a condition, oldest first, with their SLA worked out from their status history
+// - The condition gets the decided statuses as $1, and args from $2
+// - An application is submitted when its first status is recorded, and decided when it last moved to the decided status it has now
+func fetchQueue(q queryer, condition string, args ...interface{}) ([]models.QueuedApplication, error) {
+	rows, err := q.Query(`
+		SELECT applications.id, applications.applicant_id, applications.scheme_id, applications.status, applications.as_of,
+			applications.assigned_to, submitted.at, submitted.at + schemes.sla_days * INTERVAL '1 day',
+			COALESCE(CASE WHEN applications.status = ANY($1::text[]) THEN (
+				SELECT MAX(changed_at) FROM application_status_history
+				WHERE application_id = applications.id AND to_status = applications.status
+			) END, NOW()) > submitted.at + schemes.sla_days * INTERVAL '1 day'
+		FROM applications
+		JOIN schemes ON schemes.id = applications.scheme_id
+		CROSS JOIN LATERAL (
+			SELECT COALESCE(MIN(changed_at), applications.as_of::timestamptz) AS at
+			FROM application_status_history WHERE application_id = applications.id
+		) submitted
+		WHERE `+condition+`
+		ORDER BY submitted.at, applications.id`, append([]interface{}{pq.Array(utils.DecidedApplicationStatuses)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []models.QueuedApplication{}
+	for rows.Next() {
+		var application models.QueuedApplication
+		var asOf, submittedAt time.Time
+		var dueAt sql.NullTime
+		var breached sql.NullBool
+		err := rows.Scan(&application.ID, &application.ApplicantID, &application.SchemeID, &application.Status, &asOf,
+			&application.AssignedTo, &submittedAt, &dueAt, &breached)
+		if err != nil {
+			return nil, err
+		}
+		application.AsOf = asOf.Format(utils.DateLayout)
+		application.SubmittedAt = submittedAt.Format(time.RFC3339)
+		if dueAt.Valid {
+			due := dueAt.Time.Format(time.RFC3339)
+			application.DueAt = &due
+		}
+		application.Breached = breached.Bool
+		queue = append(queue, application)
+	}
+	return queue, rows.Err()
+}
+
+// Returned when no active caseworker can take an application
+var errNoCaseworker = errors.New("no active caseworker handles the application's scheme")
+
+// Pick the caseworker to assign an application to a scheme to, locking them until the transaction ends
+// - A named caseworker must be active and handle the scheme
+func pickCaseworker(tx *sql.Tx, schemeID string, assignment models.Assignment) (string, error) {
+	query := `
+		SELECT caseworkers.id FROM caseworkers
+		WHERE caseworkers.active
+		AND (NOT EXISTS (SELECT 1 FROM caseworker_schemes WHERE caseworker_id = caseworkers.id)
+			OR EXISTS (SELECT 1 FROM caseworker_schemes WHERE caseworker_id = caseworkers.id AND scheme_id = $1))`
+	args := []interface{}{schemeID}
+	switch {
+	case assignment.CaseworkerID != "":
+		query += ` AND caseworkers.id::text = $2`
+		args = append(args, assignment.CaseworkerID)
+	case assignment.Strategy == "least_loaded":
+		query += ` ORDER BY (` + openApplicationsQuery(2) + `), caseworkers.last_assigned_at NULLS FIRST, caseworkers.name`
+		args = append(args, pq.Array(utils.DecidedApplicationStatuses))
+	default:
+		query += ` ORDER BY caseworkers.last_assigned_at NULLS FIRST, caseworkers.name`
+	}
+	query += ` LIMIT 1 FOR UPDATE OF caseworkers`
+
+	var caseworkerID string
+	err := tx.QueryRow(query, args...).Scan(&caseworkerID)
+	if err == sql.ErrNoRows {
+		return "", errNoCaseworker
+	}
+	return caseworkerID, err
+}
+
+// Assign an application to a caseworker, and note when they were last assigned one for round-robin
+func assignApplication(tx *sql.Tx, applicationID, caseworkerID string) error {
+	_, err := tx.Exec(`UPDATE applications SET assigned_to = $1, assigned_at = NOW() WHERE id = $2`, caseworkerID, applicationID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE caseworkers SET last_assigned_at = clock_timestamp() WHERE id = $1`, caseworkerID)
+	return err
+}
+
+// Replace the schemes a caseworker handles, writing the error response if one does not exist
+func caseworkerSchemesSaved(w http.ResponseWriter, tx *sql.Tx, caseworkerID string, schemeIDs []string) bool {
+	_, err := tx.Exec(`DELETE FROM caseworker_schemes WHERE caseworker_id = $1`, caseworkerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unlinking schemes: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	for _, schemeID := range schemeIDs {
+		_, err = tx.Exec(`INSERT INTO caseworker_schemes (caseworker_id, scheme_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			caseworkerID, schemeID)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, fmt.Sprintf("scheme %s not found", schemeID), http.StatusBadRequest)
+			return false
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error linking scheme: %v", err), http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// Respond with a caseworker as they now are
+func respondWithCaseworker(w http.ResponseWriter, caseworkerID string, status int) {
+	caseworkers, err := fetchCaseworkers(`caseworkers.id = $2`, caseworkerID)
+	if err != nil || len(caseworkers) == 0 {
+		http.Error(w, fmt.Sprintf("Error fetching caseworker: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, status, caseworkers[0])
+}
+
+// Fetch the caseworkers matching a condition, with their schemes and undecided applications
+// - The condition gets args from $2
+func fetchCaseworkers(condition string, args ...interface{}) ([]models.Caseworker, error) {
+	rows, err := database.DB.Query(`
+		SELECT caseworkers.id, caseworkers.name, caseworkers.active,
+			ARRAY(SELECT scheme_id FROM caseworker_schemes WHERE caseworker_id = caseworkers.id),
+			(`+openApplicationsQuery(1)+`)
+		FROM caseworkers
+		WHERE `+condition+`
+		ORDER BY caseworkers.name`, append([]interface{}{pq.Array(utils.DecidedApplicationStatuses)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	caseworkers := []models.Caseworker{}
+	for rows.Next() {
+		var caseworker models.Caseworker
+		var schemeIDs pq.StringArray
+		err := rows.Scan(&caseworker.ID, &caseworker.Name, &caseworker.Active, &schemeIDs, &caseworker.OpenApplications)
+		if err != nil {
+			return nil, err
+		}
+		caseworker.SchemeIDs = schemeIDs
+		caseworkers = append(caseworkers, caseworker)
+	}
+	return caseworkers, rows.Err()
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
+)
+
+// GET request for the disbursements of an application, or of every application made by an applicant
+func GetDisbursements(w http.ResponseWriter, r *http.Request) {
+	applicationID := r.URL.Query().Get("application")
+	applicantID := r.URL.Query().Get("applicant")
+	if applicationID == "" && applicantID == "" {
+		http.Error(w, "application or applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var disbursements []models.Disbursement
+	var err error
+	if applicationID != "" {
+		disbursements, err = fetchDisbursements(`WHERE application_id = $1`, applicationID)
+	} else {
+		disbursements, err = fetchDisbursements(`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)`, applicantID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching disbursements: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, disbursements)
+}
+
+// GET request for the total amount disbursed, by currency and status
+// - Optional ?from= and ?to= (YYYY-MM-DD, inclusive) limit the totals to payments due in that period
+// - Totals are summed by Postgres as NUMERIC, so they are exact
+func GetDisbursementTotals(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT currency, status, COUNT(*), SUM(amount) FROM disbursements WHERE TRUE`
+	values := []interface{}{}
+	for _, bound := range []struct{ param, condition string }{{"from", "due_date >= "}, {"to", "due_date <= "}} {
+		value := r.URL.Query().Get(bound.param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(utils.DateLayout, value); err != nil {
+			http.Error(w, fmt.Sprintf("%s must be in YYYY-MM-DD format", bound.param), http.StatusBadRequest)
+			return
+		}
+		values = append(values, value)
+		query += " AND " + bound.condition + "$" + fmt.Sprint(len(values))
+	}
+	query += ` GROUP BY currency, status ORDER BY currency, status`
+
+	rows, err := database.DB.Query(query, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error totalling disbursements: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	totals := []models.DisbursementTotal{}
+	for rows.Next() {
+		var total models.DisbursementTotal
+		if err := rows.Scan(&total.Currency, &total.Status, &total.Count, &total.Total); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning total: %v", err), http.StatusInternalServerError)
+			return
+		}
+		totals = append(totals, total)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating totals: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, totals)
+}
+
+// Schedule the payments of an approved application's benefits
+// - Amounts are worked out from the applicant's circumstances on the application's as_of date
+// - Does nothing if the payments are already scheduled, so approving twice does not pay twice
+// - Subsidies are a percentage off something else, so they have nothing to pay out
+func generateDisbursements(tx *sql.Tx, applicationID string) error {
+	var applicantID string
+	var versionID sql.NullString
+	var asOf time.Time
+	err := tx.QueryRow(`SELECT applicant_id, scheme_version_id, as_of FROM applications WHERE id = $1 FOR UPDATE`, applicationID).
+		Scan(&applicantID, &versionID, &asOf)
+	if err != nil {
+		return err
+	}
+	if !versionID.Valid {
+		return errors.New("application is not pinned to a scheme version")
+	}
+
+	var scheduled bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM disbursements WHERE application_id = $1 AND status <> 'cancelled')`, applicationID).
+		Scan(&scheduled)
+	if err != nil || scheduled {
+		return err
+	}
+
+	// Only the household members the application is for count, and some benefits are paid for one of them
+	beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(tx, []string{applicationID})
+	if err != nil {
+		return err
+	}
+	beneficiaries := beneficiariesByApplicationID[applicationID]
+	beneficiaryByBenefitID := make(map[string]string)
+	for _, beneficiary := range beneficiaries {
+		for _, benefitID := range beneficiary.BenefitIDs {
+			beneficiaryByBenefitID[benefitID] = beneficiary.ApplicantID
+		}
+	}
+
+	applicant, err := fetchApplicantCircumstances(applicantID, asOf, beneficiaryIDs(beneficiaries))
+	if err != nil {
+		return err
+	}
+	benefitsByVersionID, err := fetchBenefitsByVersionID([]string{versionID.String})
+	if err != nil {
+		return err
+	}
+
+	event := models.DisbursementsScheduled{ApplicationID: applicationID, Disbursements: []models.Disbursement{}}
+	for _, benefit := range benefitsByVersionID[versionID.String] {
+		if benefit.Type == "subsidy_percentage" {
+			continue
+		}
+		entitlement := computeEntitlement(benefit, applicant.ChildrenCount, applicant.Finances.HouseholdSize)
+		var beneficiaryID *string
+		if id, ok := beneficiaryByBenefitID[benefit.ID]; ok {
+			beneficiaryID = &id
+		}
+
+		// The first payment is due on the as_of date, and the rest every month or quarter after
+		interval := 1
+		if benefit.Frequency == "quarterly" {
+			interval = 3
+		}
+		for payment := 1; payment <= entitlement.Duration; payment++ {
+			disbursement := models.Disbursement{
+				ApplicationID: applicationID,
+				BenefitID:     benefit.ID,
+				BeneficiaryID: beneficiaryID,
+				Payment:       payment,
+				Amount:        entitlement.AmountPerPayment,
+				Currency:      entitlement.Currency,
+				DueDate:       addMonths(asOf, interval*(payment-1)).Format(utils.DateLayout),
+			}
+			err = tx.QueryRow(`
+				INSERT INTO disbursements (id, application_id, benefit_id, beneficiary_id, payment, amount, currency, due_date)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (application_id, benefit_id, payment)
+				DO UPDATE SET beneficiary_id = EXCLUDED.beneficiary_id, amount = EXCLUDED.amount, currency = EXCLUDED.currency,
+					due_date = EXCLUDED.due_date, status = 'scheduled'
+				RETURNING id, status, created_at`,
+				uuid.New().String(), applicationID, benefit.ID, beneficiaryID, payment, disbursement.Amount, disbursement.Currency,
+				disbursement.DueDate).Scan(&disbursement.ID, &disbursement.Status, &disbursement.CreatedAt)
+			if err != nil {
+				return err
+			}
+			event.Disbursements = append(event.Disbursements, disbursement)
+		}
+	}
+
+	// Tell the payments system what to pay
+	if len(event.Disbursements) == 0 {
+		return nil
+	}
+	return webhooks.Enqueue(tx, webhooks.DisbursementScheduled, event)
+}
+
+// Cancel the payments of an application that have not been made yet
+func cancelDisbursements(tx *sql.Tx, applicationID string) error {
+	_, err := tx.Exec(`UPDATE disbursements SET status = 'cancelled' WHERE application_id = $1 AND status = 'scheduled'`, applicationID)
+	return err
+}
+
+// Add months to a date, keeping to the last day of shorter months (e.g. 31 January to 28 February)
+func addMonths(date time.Time, months int) time.Time {
+	firstOfMonth := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, months, 0)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := date.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+// Fetch disbursements matching a WHERE clause, in the order they are due
+func fetchDisbursements(where string, args ...interface{}) ([]models.Disbursement, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, application_id, benefit_id, beneficiary_id, payment, amount, currency, due_date, status, created_at
+		FROM disbursements `+where+`
+		ORDER BY due_date, application_id, benefit_id, payment`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disbursements := []models.Disbursement{}
+	for rows.Next() {
+		var disbursement models.Disbursement
+		var dueDate time.Time
+		err := rows.Scan(&disbursement.ID, &disbursement.ApplicationID, &disbursement.BenefitID, &disbursement.BeneficiaryID, &disbursement.Payment,
+			&disbursement.Amount, &disbursement.Currency, &dueDate, &disbursement.Status, &disbursement.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		disbursement.DueDate = dueDate.Format(utils.DateLayout)
+		disbursements = append(disbursements, disbursement)
+	}
+	return disbursements, rows.Err()
+}
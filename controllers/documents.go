@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for an application's documents, listing every document its scheme requires and any others submitted
+func GetApplicationDocuments(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	checklist, err := fetchDocumentChecklist(database.DB, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching documents: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, checklist)
+}
+
+// POST request to submit a document for an application, optionally pointing at the uploaded copy
+// - Submitting a document again replaces it, and it must be reviewed again
+// - The X-User header records who submitted it
+func SubmitDocument(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+
+	var submission models.DocumentSubmission
+	if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateDocumentTypes([]string{submission.DocumentType}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	// The copy must have been attached to this application, not another one
+	if submission.AttachmentID != nil {
+		var attached bool
+		err := database.DB.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM application_attachments WHERE id::text = $1 AND application_id = $2)`,
+			*submission.AttachmentID, applicationID).Scan(&attached)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching attachment: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !attached {
+			http.Error(w, "attachment not found on this application", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err := database.DB.Exec(`
+		INSERT INTO application_documents (application_id, document_type, attachment_id, submitted_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (application_id, document_type) DO UPDATE SET
+			attachment_id = EXCLUDED.attachment_id, status = 'submitted', submitted_by = EXCLUDED.submitted_by,
+			submitted_at = NOW(), reviewed_by = NULL, reviewed_at = NULL, reason = NULL`,
+		applicationID, submission.DocumentType, submission.AttachmentID, utils.RequestUser(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error submitting document: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	respondWithDocumentChecklist(w, applicationID, http.StatusCreated)
+}
+
+// POST request to verify or reject a document submitted for an application
+// - The X-User header records who reviewed it
+func ReviewDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	applicationID, documentType := vars["id"], vars["type"]
+
+	var review models.DocumentReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Status != "verified" && review.Status != "rejected" {
+		http.Error(w, "status must be verified or rejected", http.StatusBadRequest)
+		return
+	}
+	if review.Status == "rejected" && review.Reason == "" {
+		http.Error(w, "a reason is required to reject a document", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE application_documents SET status = $1, reason = NULLIF($2, ''), reviewed_by = NULLIF($3, ''), reviewed_at = NOW()
+		WHERE application_id::text = $4 AND document_type = $5`,
+		review.Status, review.Reason, utils.RequestUser(r), applicationID, documentType)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reviewing document: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		http.Error(w, "document has not been submitted for this application", http.StatusNotFound)
+		return
+	}
+
+	respondWithDocumentChecklist(w, applicationID, http.StatusOK)
+}
+
+// Respond with an application's documents as they now are
+func respondWithDocumentChecklist(w http.ResponseWriter, applicationID string, status int) {
+	checklist, err := fetchDocumentChecklist(database.DB, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching documents: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, status, checklist)
+}
+
+// Check a list of document types, which must be unique names of up to 100 characters
+func validateDocumentTypes(documentTypes []string) error {
+	seen := make(map[string]bool)
+	for _, documentType := range documentTypes {
+		if strings.TrimSpace(documentType) == "" {
+			return errors.New("document_type is required")
+		}
+		if len(documentType) > 100 {
+			return errors.New("document types cannot be longer than 100 characters")
+		}
+		if seen[documentType] {
+			return fmt.Errorf("document type %q is listed more than once", documentType)
+		}
+		seen[documentType] = true
+	}
+	return nil
+}
+
+// Replace the documents a scheme requires
+func saveRequiredDocuments(tx *sql.Tx, schemeID string, documentTypes []string) error {
+	_, err := tx.Exec(`DELETE FROM scheme_required_documents WHERE scheme_id = $1`, schemeID)
+	if err != nil {
+		return err
+	}
+	for _, documentType := range documentTypes {
+		_, err = tx.Exec(`INSERT INTO scheme_required_documents (scheme_id, document_type) VALUES ($1, $2)`, schemeID, documentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch the documents a scheme requires, in name order
+func fetchRequiredDocuments(q queryer, schemeID string) ([]string, error) {
+	rows, err := q.Query(`SELECT document_type FROM scheme_required_documents WHERE scheme_id = $1 ORDER BY document_type`, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documentTypes := []string{}
+	for rows.Next() {
+		var documentType string
+		if err := rows.Scan(&documentType); err != nil {
+			return nil, err
+		}
+		documentTypes = append(documentTypes, documentType)
+	}
+	return documentTypes, rows.Err()
+}
+
+// Fetch an application's documents against what its scheme currently requires
+// - Required documents come first, each marked missing until it is submitted
+func fetchDocumentChecklist(q queryer, applicationID string) (models.DocumentChecklist, error) {
+	checklist := models.DocumentChecklist{ApplicationID: applicationID, Complete: true, Documents: []models.ApplicationDocument{}}
+	rows, err := q.Query(`
+		WITH required AS (
+			SELECT scheme_required_documents.document_type FROM scheme_required_documents
+			JOIN applications ON applications.scheme_id = scheme_required_documents.scheme_id
+			WHERE applications.id::text = $1
+		)
+		SELECT COALESCE(required.document_type, application_documents.document_type), required.document_type IS NOT NULL,
+			COALESCE(application_documents.status, 'missing'), application_documents.attachment_id,
+			application_documents.submitted_by, application_documents.submitted_at,
+			application_documents.reviewed_by, application_documents.reviewed_at, application_documents.reason
+		FROM required
+		FULL JOIN (SELECT * FROM application_documents WHERE application_id::text = $1) application_documents
+			ON application_documents.document_type = required.document_type
+		ORDER BY required.document_type IS NULL, 1`, applicationID)
+	if err != nil {
+		return checklist, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var document models.ApplicationDocument
+		err := rows.Scan(&document.DocumentType, &document.Required, &document.Status, &document.AttachmentID,
+			&document.SubmittedBy, &document.SubmittedAt, &document.ReviewedBy, &document.ReviewedAt, &document.Reason)
+		if err != nil {
+			return checklist, err
+		}
+		if document.Required && document.Status != "verified" {
+			checklist.Complete = false
+		}
+		checklist.Documents = append(checklist.Documents, document)
+	}
+	return checklist, rows.Err()
+}
+
+// Check that an application's required documents have all been verified, before it can be reviewed
+// - Returns which are not, or "" if they all are
+func checkDocumentsVerified(tx *sql.Tx, applicationID string) (string, error) {
+	checklist, err := fetchDocumentChecklist(tx, applicationID)
+	if err != nil || checklist.Complete {
+		return "", err
+	}
+
+	outstanding := []string{}
+	for _, document := range checklist.Documents {
+		if document.Required && document.Status != "verified" {
+			outstanding = append(outstanding, fmt.Sprintf("%s (%s)", document.DocumentType, document.Status))
+		}
+	}
+	return "required documents have not been verified: " + strings.Join(outstanding, ", "), nil
+}
+
+// Check that an application's required documents have been verified, writing the error response if they have not
+func documentsVerified(w http.ResponseWriter, tx *sql.Tx, applicationID string) bool {
+	reason, err := checkDocumentsVerified(tx, applicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking documents: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, reason, http.StatusConflict)
+		return false
+	}
+	return true
+}
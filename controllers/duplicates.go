@@ -0,0 +1,572 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// Pairs scoring below this are not worth a reviewer's time
+const defaultDuplicateMinScore = 0.6
+
+// POST request to scan all applicants for likely duplicates and queue them for review
+// - Pairs are scored on name similarity, date of birth and household overlap
+func ScanDuplicates(w http.ResponseWriter, r *http.Request) {
+	minScore := defaultDuplicateMinScore
+	if value := r.URL.Query().Get("min_score"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			http.Error(w, "min_score must be a number between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		minScore = parsed
+	}
+
+	// Fetch every applicant that has not been anonymised
+	rows, err := database.DB.Query(`SELECT id, name, date_of_birth, COALESCE(national_id, '') FROM applicants WHERE anonymised_at IS NULL`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching applicants: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Group applicants by year of birth, so that we only compare people who could plausibly be the same
+	// - A year that does not parse is kept as its own group
+	byBirthYear := make(map[string][]models.Applicant)
+	for rows.Next() {
+		var applicant models.Applicant
+		if err := rows.Scan(&applicant.ID, &applicant.Name, &applicant.DateOfBirth, &applicant.NationalID); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := decryptApplicant(&applicant); err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		year := applicant.DateOfBirth[:min(4, len(applicant.DateOfBirth))]
+		byBirthYear[year] = append(byBirthYear[year], applicant)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating applicants: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch who each applicant is related to
+	households, err := fetchHouseholds()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching relations: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Score every pair born in the same year or a year apart, as a date of birth may have been mistyped
+	candidates := []models.DuplicateCandidate{}
+	addCandidate := func(a, b models.Applicant) {
+		score, reasons, ok := scoreDuplicate(a, b, households)
+		if !ok || score < minScore {
+			return
+		}
+
+		// Store each pair in a fixed order so that it is only queued once
+		first, second := a.ID, b.ID
+		if first > second {
+			first, second = second, first
+		}
+		candidates = append(candidates, models.DuplicateCandidate{
+			ID:           uuid.New().String(),
+			ApplicantID1: first,
+			ApplicantID2: second,
+			Score:        score,
+			Reasons:      reasons,
+			Status:       "pending",
+		})
+	}
+	for year, group := range byBirthYear {
+		for i := 0; i < len(group); i++ {
+			for j := i + 1; j < len(group); j++ {
+				addCandidate(group[i], group[j])
+			}
+		}
+		born, err := strconv.Atoi(year)
+		if err != nil {
+			continue
+		}
+		for _, a := range group {
+			for _, b := range byBirthYear[fmt.Sprintf("%04d", born+1)] {
+				addCandidate(a, b)
+			}
+		}
+	}
+
+	// Queue the candidates, refreshing the score of pairs that are still pending
+	// - Pairs that have already been merged or dismissed are left alone
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, candidate := range candidates {
+		_, err = tx.Exec(`
+			INSERT INTO duplicate_candidates (id, applicant_id1, applicant_id2, score, reasons)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (applicant_id1, applicant_id2) DO UPDATE
+			SET score = EXCLUDED.score, reasons = EXCLUDED.reasons, detected_at = NOW()
+			WHERE duplicate_candidates.status = 'pending'`,
+			candidate.ID, candidate.ApplicantID1, candidate.ApplicantID2, candidate.Score, pq.Array(candidate.Reasons))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error queueing duplicate candidate: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, candidates)
+}
+
+// GET request for the duplicate review queue, most likely duplicates first
+// - ?status= picks pending (default), merged or dismissed candidates
+func GetDuplicateCandidates(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	query := `
+		SELECT id, applicant_id1, applicant_id2, score, reasons, status, detected_at
+		FROM duplicate_candidates
+		WHERE status = $1
+		ORDER BY score DESC, detected_at`
+	rows, err := database.DB.Query(query, status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching duplicate candidates: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	candidates := []models.DuplicateCandidate{}
+	for rows.Next() {
+		var candidate models.DuplicateCandidate
+		var reasons pq.StringArray
+		err := rows.Scan(&candidate.ID, &candidate.ApplicantID1, &candidate.ApplicantID2, &candidate.Score,
+			&reasons, &candidate.Status, &candidate.DetectedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning duplicate candidate: %v", err), http.StatusInternalServerError)
+			return
+		}
+		candidate.Reasons = reasons
+		candidates = append(candidates, candidate)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating duplicate candidates: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, candidates)
+}
+
+// POST request to mark a pending pair as not being the same person
+func DismissDuplicate(w http.ResponseWriter, r *http.Request) {
+	candidateID := r.URL.Query().Get("candidate")
+	if candidateID == "" {
+		http.Error(w, "candidate ID is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`UPDATE duplicate_candidates SET status = 'dismissed' WHERE id = $1 AND status = 'pending'`, candidateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error dismissing duplicate candidate: %v", err), http.StatusInternalServerError)
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error dismissing duplicate candidate: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "no pending duplicate candidate with this ID", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Duplicate candidate dismissed successfully"))
+}
+
+// POST request to merge a duplicate applicant into the surviving one
+// - Applications and relations are re-pointed to the survivor, then the duplicate is deleted
+func MergeApplicants(w http.ResponseWriter, r *http.Request) {
+	survivorID := r.URL.Query().Get("survivor")
+	duplicateID := r.URL.Query().Get("duplicate")
+	if survivorID == "" || duplicateID == "" {
+		http.Error(w, "survivor and duplicate IDs are required", http.StatusBadRequest)
+		return
+	}
+	if survivorID == duplicateID {
+		http.Error(w, "an applicant cannot be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	// Start a transaction so that the merge happens all at once or not at all
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock both applicants, and fetch their national IDs
+	var survivorNationalID, duplicateNationalID, duplicateNationalIDIndex sql.NullString
+	var survivorAnonymised, duplicateAnonymised bool
+	err = tx.QueryRow(`SELECT national_id, anonymised_at IS NOT NULL FROM applicants WHERE id = $1 FOR UPDATE`, survivorID).
+		Scan(&survivorNationalID, &survivorAnonymised)
+	if err == sql.ErrNoRows {
+		http.Error(w, "survivor applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching survivor applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = tx.QueryRow(`SELECT national_id, national_id_index, anonymised_at IS NOT NULL FROM applicants WHERE id = $1 FOR UPDATE`, duplicateID).
+		Scan(&duplicateNationalID, &duplicateNationalIDIndex, &duplicateAnonymised)
+	if err == sql.ErrNoRows {
+		http.Error(w, "duplicate applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching duplicate applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// An anonymised applicant can no longer be identified, so there is nothing to merge
+	if survivorAnonymised || duplicateAnonymised {
+		http.Error(w, "anonymised applicants cannot be merged", http.StatusConflict)
+		return
+	}
+
+	// Two different national IDs means two different people
+	if survivorNationalID.Valid && duplicateNationalID.Valid {
+		survivorValue, err := encryption.Decrypt(survivorNationalID.String)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		duplicateValue, err := encryption.Decrypt(duplicateNationalID.String)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting applicant: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if survivorValue != duplicateValue {
+			http.Error(w, "applicants have different national IDs and cannot be merged", http.StatusConflict)
+			return
+		}
+	}
+
+	merge := models.ApplicantMerge{
+		ID:         uuid.New().String(),
+		SurvivorID: survivorID,
+		MergedID:   duplicateID,
+	}
+
+	// 1. Re-point the duplicate's applications, which must stay within their schemes' limits for the survivor
+	// - e.g. both applicants having an open application to the same scheme, or too many grants between them
+	rows, err := tx.Query(`UPDATE applications SET applicant_id = $1 WHERE applicant_id = $2 RETURNING id`, survivorID, duplicateID)
+	if isOpenApplicationViolation(err) {
+		http.Error(w, "both applicants have an open application for the same scheme", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	movedApplicationIDs := []string{}
+	for rows.Next() {
+		var applicationID string
+		if err := rows.Scan(&applicationID); err != nil {
+			rows.Close()
+			http.Error(w, fmt.Sprintf("Error scanning application: %v", err), http.StatusInternalServerError)
+			return
+		}
+		movedApplicationIDs = append(movedApplicationIDs, applicationID)
+	}
+	rows.Close()
+	if isOpenApplicationViolation(rows.Err()) {
+		http.Error(w, "both applicants have an open application for the same scheme", http.StatusConflict)
+		return
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error moving applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, applicationID := range movedApplicationIDs {
+		if !withinApplicationLimits(w, tx, applicationID, false) {
+			return
+		}
+	}
+	merge.ApplicationsMoved = len(movedApplicationIDs)
+
+	// 2. Copy the duplicate's relations onto the survivor, skipping ones the survivor already has
+	// - Relations between the two applicants themselves are dropped
+	relationQueries := []string{
+		`INSERT INTO relations (id1, id2, relation)
+		SELECT $1, id2, relation FROM relations WHERE id1 = $2 AND id2 <> $1
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO relations (id1, id2, relation)
+		SELECT id1, $1, relation FROM relations WHERE id2 = $2 AND id1 <> $1
+		ON CONFLICT DO NOTHING`,
+	}
+	for _, query := range relationQueries {
+		result, err := tx.Exec(query, survivorID, duplicateID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error moving relations: %v", err), http.StatusInternalServerError)
+			return
+		}
+		moved, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error moving relations: %v", err), http.StatusInternalServerError)
+			return
+		}
+		merge.RelationsMoved += int(moved)
+	}
+
+	// 3. Move the duplicate's financial records, unless the survivor already has one for the same date
+	_, err = tx.Exec(`
+		UPDATE financial_records SET applicant_id = $1
+		WHERE applicant_id = $2
+		AND effective_from NOT IN (SELECT effective_from FROM financial_records WHERE applicant_id = $1)`,
+		survivorID, duplicateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving financial records: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 4. Move the duplicate's place as a beneficiary, unless the survivor is already on the same application
+	beneficiaryQueries := []string{
+		`UPDATE application_beneficiaries SET applicant_id = $1
+		WHERE applicant_id = $2
+		AND application_id NOT IN (SELECT application_id FROM application_beneficiaries WHERE applicant_id = $1)
+		AND application_id NOT IN (SELECT id FROM applications WHERE applicant_id = $1)`,
+		`UPDATE disbursements SET beneficiary_id = $1 WHERE beneficiary_id = $2`,
+	}
+	for _, query := range beneficiaryQueries {
+		if _, err = tx.Exec(query, survivorID, duplicateID); err != nil {
+			http.Error(w, fmt.Sprintf("Error moving beneficiaries: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 5. Move the notifications sent to the duplicate, and their contact details if the survivor has none
+	// - Outreach matches move too, unless the survivor was already told about the same scheme
+	notificationQueries := []string{
+		`UPDATE notifications SET applicant_id = $1 WHERE applicant_id = $2`,
+		`UPDATE applicant_contacts SET applicant_id = $1
+		WHERE applicant_id = $2
+		AND NOT EXISTS (SELECT 1 FROM applicant_contacts WHERE applicant_id = $1)`,
+		`UPDATE outreach_matches SET applicant_id = $1
+		WHERE applicant_id = $2
+		AND scheme_id NOT IN (SELECT scheme_id FROM outreach_matches WHERE applicant_id = $1)`,
+	}
+	for _, query := range notificationQueries {
+		if _, err = tx.Exec(query, survivorID, duplicateID); err != nil {
+			http.Error(w, fmt.Sprintf("Error moving notifications: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 6. Move the duplicate's dated marital status changes, unless the survivor already has one from the same date
+	// - The status the duplicate was registered with is left behind, as the survivor has its own
+	maritalQueries := []string{
+		`UPDATE marital_status_history SET applicant_id = $1
+		WHERE applicant_id = $2 AND effective_from IS NOT NULL
+		AND effective_from NOT IN (SELECT effective_from FROM marital_status_history WHERE applicant_id = $1 AND effective_from IS NOT NULL)`,
+		`UPDATE marital_status_history SET spouse_id = $1 WHERE spouse_id = $2`,
+	}
+	for _, query := range maritalQueries {
+		if _, err = tx.Exec(query, survivorID, duplicateID); err != nil {
+			http.Error(w, fmt.Sprintf("Error moving marital status history: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 7. Delete the duplicate along with its old relations
+	_, err = tx.Exec(`DELETE FROM relations WHERE id1 = $1 OR id2 = $1`, duplicateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting relations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`DELETE FROM applicants WHERE id = $1`, duplicateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting duplicate applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 8. Keep the duplicate's national ID if the survivor does not have one
+	// - This has to happen after the delete, as national IDs are unique
+	if !survivorNationalID.Valid && duplicateNationalID.Valid {
+		_, err = tx.Exec(`UPDATE applicants SET national_id = $1, national_id_index = $2 WHERE id = $3`,
+			duplicateNationalID, duplicateNationalIDIndex, survivorID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error moving national ID: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 9. Record the merge in history, and resolve the review queue
+	err = tx.QueryRow(`
+		INSERT INTO applicant_merges (id, survivor_id, merged_id, applications_moved, relations_moved)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING merged_at`,
+		merge.ID, merge.SurvivorID, merge.MergedID, merge.ApplicationsMoved, merge.RelationsMoved).Scan(&merge.MergedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error recording merge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE duplicate_candidates SET status = 'merged'
+		WHERE (applicant_id1 = $1 AND applicant_id2 = $2) OR (applicant_id1 = $2 AND applicant_id2 = $1)`,
+		survivorID, duplicateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating duplicate candidates: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Other pending pairs involving the duplicate no longer make sense
+	_, err = tx.Exec(`
+		DELETE FROM duplicate_candidates
+		WHERE status = 'pending' AND (applicant_id1 = $1 OR applicant_id2 = $1)`, duplicateID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating duplicate candidates: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Commit the transaction to save all the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, merge)
+}
+
+// GET request for the history of merges, newest first
+func GetApplicantMerges(w http.ResponseWriter, r *http.Request) {
+	merges, err := fetchApplicantMerges(``)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching merges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, merges)
+}
+
+// Fetch merges matching a WHERE clause, newest first
+func fetchApplicantMerges(where string, args ...interface{}) ([]models.ApplicantMerge, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, survivor_id, merged_id, applications_moved, relations_moved, merged_at
+		FROM applicant_merges `+where+`
+		ORDER BY merged_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	merges := []models.ApplicantMerge{}
+	for rows.Next() {
+		var merge models.ApplicantMerge
+		err := rows.Scan(&merge.ID, &merge.SurvivorID, &merge.MergedID, &merge.ApplicationsMoved, &merge.RelationsMoved, &merge.MergedAt)
+		if err != nil {
+			return nil, err
+		}
+		merges = append(merges, merge)
+	}
+	return merges, rows.Err()
+}
+
+// Fetch the set of applicants each applicant is related to, in either direction
+func fetchHouseholds() (map[string]map[string]bool, error) {
+	rows, err := database.DB.Query(`SELECT id1, id2 FROM relations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	households := make(map[string]map[string]bool)
+	for rows.Next() {
+		var id1, id2 string
+		if err := rows.Scan(&id1, &id2); err != nil {
+			return nil, err
+		}
+		if households[id1] == nil {
+			households[id1] = make(map[string]bool)
+		}
+		if households[id2] == nil {
+			households[id2] = make(map[string]bool)
+		}
+		households[id1][id2] = true
+		households[id2][id1] = true
+	}
+	return households, rows.Err()
+}
+
+// Score how likely two applicants are to be the same person, from 0 to 1
+// - Name similarity counts for up to 0.5, the same date of birth for 0.3 and shared household members for up to 0.2
+// - Returns false for pairs that are known to be different people
+func scoreDuplicate(a, b models.Applicant, households map[string]map[string]bool) (float64, []string, bool) {
+	// Different national IDs, or being related to each other, rules the pair out
+	if a.NationalID != "" && b.NationalID != "" && a.NationalID != b.NationalID {
+		return 0, nil, false
+	}
+	if households[a.ID][b.ID] {
+		return 0, nil, false
+	}
+
+	score := 0.0
+	reasons := []string{}
+
+	if a.NationalID != "" && a.NationalID == b.NationalID {
+		reasons = append(reasons, "same_national_id")
+	}
+
+	nameSimilarity := utils.NameSimilarity(a.Name, b.Name)
+	score += 0.5 * nameSimilarity
+	if nameSimilarity == 1 {
+		reasons = append(reasons, "same_name")
+	} else if nameSimilarity >= 0.8 {
+		reasons = append(reasons, "similar_name")
+	}
+
+	if a.DateOfBirth == b.DateOfBirth {
+		score += 0.3
+		reasons = append(reasons, "same_date_of_birth")
+	}
+
+	// Share of household members in common (Jaccard similarity)
+	shared, total := 0, len(households[a.ID])
+	for member := range households[b.ID] {
+		if households[a.ID][member] {
+			shared++
+		} else {
+			total++
+		}
+	}
+	if shared > 0 {
+		score += 0.2 * float64(shared) / float64(total)
+		reasons = append(reasons, "shared_household")
+	}
+
+	return score, reasons, true
+}
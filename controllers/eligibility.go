@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// Returned when eligibility is checked for an applicant that does not exist
+var errApplicantNotFound = errors.New("applicant not found")
+
+// Work out the applicant's circumstances on a date
+// - Marital status, children's ages and finances are taken as they were on that date
+// - Employment status has no history, so the current one is used
+// - If beneficiaryIDs is not nil, only the children among them are counted
+func fetchApplicantCircumstances(applicantID string, asOf time.Time, beneficiaryIDs []string) (models.ApplicantResponse, error) {
+	var applicant models.ApplicantResponse
+
+	// Marital status comes from the latest change on or before the date
+	// - Falls back to the current status if the applicant has no history before the date
+	query := `
+		SELECT id, employment_status, COALESCE((
+			SELECT marital_status FROM marital_status_history
+			WHERE applicant_id = applicants.id AND (effective_from IS NULL OR effective_from <= $2)
+			ORDER BY effective_from DESC NULLS LAST, recorded_at DESC
+			LIMIT 1
+		), marital_status)
+		FROM applicants
+		WHERE id = $1`
+	err := database.DB.QueryRow(query, applicantID, asOf.Format(utils.DateLayout)).
+		Scan(&applicant.ID, &applicant.EmploymentStatus, &applicant.MaritalStatus)
+	if err == sql.ErrNoRows {
+		return applicant, errApplicantNotFound
+	}
+	if err != nil {
+		return applicant, fmt.Errorf("fetching applicant: %v", err)
+	}
+
+	// Beneficiaries must be members of the applicant's household
+	if beneficiaryIDs != nil {
+		members, err := fetchHouseholdMemberIDs(database.DB, applicantID)
+		if err != nil {
+			return applicant, fmt.Errorf("fetching household: %v", err)
+		}
+		for _, id := range beneficiaryIDs {
+			if !members[id] {
+				return applicant, fmt.Errorf("beneficiary %s %w", id, errNotInHousehold)
+			}
+		}
+	}
+
+	// Fetch children related to the applicant and calculate education levels
+	// - Relations may be stored in either direction, so a child may also be recorded with the applicant as their parent
+	childrenQuery := `
+		SELECT applicants.id, date_of_birth, COALESCE(education_level_override, '')
+		FROM relations
+		JOIN applicants ON applicants.id = CASE WHEN relations.id1 = $1 THEN relations.id2 ELSE relations.id1 END
+		WHERE (relations.id1 = $1 AND relations.relation = 'child')
+			OR (relations.id2 = $1 AND relations.relation = 'parent')`
+	rows, err := database.DB.Query(childrenQuery, applicantID)
+	if err != nil {
+		return applicant, fmt.Errorf("fetching children: %v", err)
+	}
+	defer rows.Close()
+
+	beneficiaries := make(map[string]bool)
+	for _, id := range beneficiaryIDs {
+		beneficiaries[id] = true
+	}
+
+	// Create a set to track all the unique education levels of the applicant's children
+	childrenEducationLevels := make(map[string]bool)
+	for rows.Next() {
+		var childID string
+		var dob string
+		var override string
+		if err := rows.Scan(&childID, &dob, &override); err != nil {
+			return applicant, fmt.Errorf("scanning child: %v", err)
+		}
+		dob, err = encryption.Decrypt(dob)
+		if err != nil {
+			return applicant, fmt.Errorf("decrypting child: %v", err)
+		}
+
+		// Children born after the date did not count yet, and neither do children the application is not for
+		if dob > asOf.Format(utils.DateLayout) || (beneficiaryIDs != nil && !beneficiaries[childID]) {
+			continue
+		}
+
+		// Calculate the child's education level from their age, unless it has been set explicitly
+		level, err := utils.EducationLevelOn(dob, override, asOf)
+		if err != nil {
+			return applicant, fmt.Errorf("calculating education level of child %s: %v", childID, err)
+		}
+		childrenEducationLevels[level] = true
+		applicant.ChildrenCount++
+	}
+	if err = rows.Err(); err != nil {
+		return applicant, fmt.Errorf("iterating children: %v", err)
+	}
+
+	// Convert map to a slice of unique education levels
+	for level := range childrenEducationLevels {
+		applicant.ChildrenLevel = append(applicant.ChildrenLevel, level)
+	}
+
+	// Compute the household's finances for means-tested schemes
+	// - Without any financial records these stay NULL, which fails every means test
+	finances, err := fetchHouseholdFinances(applicantID, asOf)
+	if err != nil {
+		return applicant, fmt.Errorf("computing household finances: %v", err)
+	}
+	applicant.Finances = finances
+
+	return applicant, nil
+}
+
+// Fetch the schemes an applicant was eligible for on a date
+// - If beneficiaryIDs is not nil, eligibility is for those members of the household only
+func fetchEligibleSchemes(applicantID string, asOf time.Time, beneficiaryIDs []string) ([]models.Scheme, error) {
+	applicant, err := fetchApplicantCircumstances(applicantID, asOf, beneficiaryIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch eligible schemes based on the applicant's marital status, employment status, children education levels and finances
+	schemes := []models.Scheme{}
+
+	// We take the version of each scheme that was in effect on the date
+	// Then, we left join each of its criteria to a criteria in the criteria table
+	// Then, we check that our conditions are fulfilled
+	// In the last row, we check that the count of actual criteria matched with the total number of criteria specified for the version
+	schemeQuery := `
+    SELECT schemes.id, scheme_versions.name, scheme_versions.id, scheme_versions.version, ` + schemeWindowColumns + `
+    FROM schemes
+    JOIN scheme_versions ON scheme_versions.scheme_id = schemes.id
+      AND scheme_versions.effective_from <= $6
+      AND (scheme_versions.effective_to IS NULL OR scheme_versions.effective_to > $6)
+    LEFT JOIN scheme_version_criteria ON scheme_versions.id = scheme_version_criteria.version_id
+    LEFT JOIN criteria ON criteria.id = scheme_version_criteria.criteria_id
+    WHERE (criteria.marital_status IS NULL OR criteria.marital_status = $1)
+      AND (criteria.employment_status IS NULL OR criteria.employment_status = $2)
+      AND (criteria.education_levels IS NULL OR criteria.education_levels && $3::text[])
+      AND (criteria.max_household_income_per_capita IS NULL OR $4::numeric <= criteria.max_household_income_per_capita)
+      AND (criteria.max_savings IS NULL OR $5::numeric <= criteria.max_savings)
+    GROUP BY schemes.id, scheme_versions.id, scheme_versions.name, scheme_versions.version
+    HAVING COUNT(criteria.id) = (
+        SELECT COUNT(*) FROM scheme_version_criteria WHERE scheme_version_criteria.version_id = scheme_versions.id
+    );`
+
+	// Make the applicant's children education array into a Postgres Array
+	// Use it in our SQL query
+	educationLevelArray := pq.Array(applicant.ChildrenLevel)
+	rows, err := database.DB.Query(schemeQuery, applicant.MaritalStatus, applicant.EmploymentStatus, educationLevelArray,
+		applicant.Finances.HouseholdIncomePerCapita, applicant.Finances.Savings, asOf.Format(utils.DateLayout))
+	if err != nil {
+		return nil, fmt.Errorf("fetching eligible scheme: %v", err)
+	}
+	defer rows.Close()
+
+	// Update our final array for return
+	for rows.Next() {
+		var scheme models.Scheme
+		window, err := scanSchemeWindow(rows, &scheme.ID, &scheme.Name, &scheme.VersionID, &scheme.Version)
+		if err != nil {
+			return nil, fmt.Errorf("scanning scheme: %v", err)
+		}
+		scheme.SchemeWindow = window
+		accepting := acceptsApplications(window, asOf)
+		scheme.AcceptingApplications = &accepting
+		schemes = append(schemes, scheme)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating scheme: %v", err)
+	}
+
+	// Work out what the applicant would receive from each scheme
+	versionIDs := make([]string, len(schemes))
+	for i, scheme := range schemes {
+		versionIDs[i] = scheme.VersionID
+	}
+	benefitsByVersionID, err := fetchBenefitsByVersionID(versionIDs)
+	if err != nil {
+		return nil, fmt.Errorf("fetching benefits: %v", err)
+	}
+	for i, scheme := range schemes {
+		schemes[i].Entitlements = []models.Entitlement{}
+		for _, benefit := range benefitsByVersionID[scheme.VersionID] {
+			entitlement := computeEntitlement(benefit, applicant.ChildrenCount, applicant.Finances.HouseholdSize)
+			schemes[i].Entitlements = append(schemes[i].Entitlements, entitlement)
+		}
+	}
+
+	// Flag the schemes that the applicant's existing grants rule out
+	// - They stay in the list, as the applicant is still eligible for them
+	groups, err := fetchSchemeGroups(`TRUE`)
+	if err != nil {
+		return nil, fmt.Errorf("fetching scheme groups: %v", err)
+	}
+	if len(groups) > 0 {
+		grants, err := fetchGrants(applicantID, "")
+		if err != nil {
+			return nil, fmt.Errorf("fetching grants: %v", err)
+		}
+		for i, scheme := range schemes {
+			schemes[i].ExcludedBy = findGroupConflict(groups, grants, scheme.ID, asOf, scheme.Entitlements)
+		}
+	}
+
+	return schemes, nil
+}
+
+// Parse an optional as_of date, defaulting to today
+func parseAsOf(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	asOf, err := time.Parse(utils.DateLayout, value)
+	if err != nil {
+		return time.Time{}, errors.New("as_of must be in YYYY-MM-DD format")
+	}
+	return asOf, nil
+}
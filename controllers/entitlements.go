@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+)
+
+// Work out what a benefit pays an applicant with the given number of children and household size
+// - Each payment is the base amount, plus the per child and per household member amounts, up to the cap
+func computeEntitlement(benefit models.Benefit, children, householdSize int) models.Entitlement {
+	amount := benefit.Amount
+	if benefit.PerChildAmount != nil {
+		amount += benefit.PerChildAmount.Times(children)
+	}
+	if benefit.PerHouseholdMemberAmount != nil {
+		amount += benefit.PerHouseholdMemberAmount.Times(householdSize)
+	}
+	if benefit.MaxAmount != nil && amount > *benefit.MaxAmount {
+		amount = *benefit.MaxAmount
+	}
+
+	entitlement := models.Entitlement{
+		BenefitID:        benefit.ID,
+		Name:             benefit.Name,
+		Type:             benefit.Type,
+		Currency:         benefit.Currency,
+		Frequency:        benefit.Frequency,
+		Duration:         benefit.Duration,
+		AmountPerPayment: amount,
+	}
+
+	// A subsidy is a percentage off something else, so it has no value of its own to total
+	if benefit.Type != "subsidy_percentage" {
+		total := amount.Times(benefit.Duration)
+		entitlement.Total = &total
+	}
+	return entitlement
+}
+
+// Fetch the benefits of several scheme versions in one query, by version ID
+func fetchBenefitsByVersionID(versionIDs []string) (map[string][]models.Benefit, error) {
+	benefitsByVersionID := make(map[string][]models.Benefit)
+	if len(versionIDs) == 0 {
+		return benefitsByVersionID, nil
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT scheme_version_benefits.version_id, `+benefitColumns+`
+		FROM scheme_version_benefits
+		JOIN benefits ON benefits.id = scheme_version_benefits.benefit_id
+		WHERE scheme_version_benefits.version_id = ANY($1::uuid[])`, pq.Array(versionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var versionID string
+		benefit, err := scanBenefit(rows, &versionID)
+		if err != nil {
+			return nil, err
+		}
+		benefitsByVersionID[versionID] = append(benefitsByVersionID[versionID], benefit)
+	}
+	return benefitsByVersionID, rows.Err()
+}
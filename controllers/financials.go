@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for an applicant's financial records, newest first
+func GetFinancialRecords(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	records, err := fetchFinancialRecords(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching financial records: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, records)
+}
+
+// POST request to record an applicant's income and assets from a date
+// - effective_from defaults to today, and a record on the same date is replaced
+func CreateFinancialRecord(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var record models.FinancialRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if record.MonthlyIncome < 0 || record.Savings < 0 {
+		http.Error(w, "monthly_income and savings cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if record.EffectiveFrom == "" {
+		record.EffectiveFrom = time.Now().Format(utils.DateLayout)
+	}
+	if _, err := time.Parse(utils.DateLayout, record.EffectiveFrom); err != nil {
+		http.Error(w, "effective_from must be in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	record.ID = uuid.New().String()
+	record.ApplicantID = applicantID
+
+	query := `
+		INSERT INTO financial_records (id, applicant_id, monthly_income, savings, owns_property, effective_from)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (applicant_id, effective_from) DO UPDATE
+		SET monthly_income = EXCLUDED.monthly_income, savings = EXCLUDED.savings, owns_property = EXCLUDED.owns_property
+		RETURNING id`
+	err := database.DB.QueryRow(query, record.ID, record.ApplicantID, record.MonthlyIncome, record.Savings,
+		record.OwnsProperty, record.EffectiveFrom).Scan(&record.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating financial record: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, record)
+}
+
+// GET request for the computed finances of an applicant's household today
+func GetHouseholdFinances(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	finances, err := fetchHouseholdFinances(applicantID, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error computing household finances: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, finances)
+}
+
+// Fetch an applicant's financial records, newest first
+func fetchFinancialRecords(applicantID string) ([]models.FinancialRecord, error) {
+	query := `
+		SELECT id, applicant_id, monthly_income, savings, owns_property, effective_from
+		FROM financial_records
+		WHERE applicant_id = $1
+		ORDER BY effective_from DESC`
+	rows, err := database.DB.Query(query, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []models.FinancialRecord{}
+	for rows.Next() {
+		var record models.FinancialRecord
+		var effectiveFrom time.Time
+		err := rows.Scan(&record.ID, &record.ApplicantID, &record.MonthlyIncome, &record.Savings, &record.OwnsProperty, &effectiveFrom)
+		if err != nil {
+			return nil, err
+		}
+		record.EffectiveFrom = effectiveFrom.Format(utils.DateLayout)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Compute the per-capita monthly income of an applicant's household, and the applicant's savings, on a date
+// - The household is the applicant plus everyone directly related to them
+// - Members without a financial record count as having no income
+func fetchHouseholdFinances(applicantID string, asOf time.Time) (models.HouseholdFinances, error) {
+	query := `
+		WITH household AS (
+			SELECT $1::uuid AS id
+			UNION SELECT id2 FROM relations WHERE id1 = $1
+			UNION SELECT id1 FROM relations WHERE id2 = $1
+		),
+		latest AS (
+			SELECT DISTINCT ON (applicant_id) applicant_id, monthly_income, savings
+			FROM financial_records
+			WHERE applicant_id IN (SELECT id FROM household) AND effective_from <= $2
+			ORDER BY applicant_id, effective_from DESC
+		)
+		SELECT
+			COUNT(*),
+			CASE WHEN COUNT(latest.applicant_id) = 0 THEN NULL
+				ELSE ROUND(COALESCE(SUM(latest.monthly_income), 0) / COUNT(*), 2) END,
+			MAX(latest.savings) FILTER (WHERE latest.applicant_id = $1)
+		FROM household
+		LEFT JOIN latest ON latest.applicant_id = household.id`
+
+	var finances models.HouseholdFinances
+	err := database.DB.QueryRow(query, applicantID, asOf.Format(utils.DateLayout)).
+		Scan(&finances.HouseholdSize, &finances.HouseholdIncomePerCapita, &finances.Savings)
+	return finances, err
+}
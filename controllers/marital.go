@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// An applicant's marital status today, from the latest change in their history that has taken effect
+// - Falls back to the stored status if the applicant has no history
+const currentMaritalStatus = `COALESCE((
+			SELECT marital_status FROM marital_status_history
+			WHERE applicant_id = applicants.id AND (effective_from IS NULL OR effective_from <= CURRENT_DATE)
+			ORDER BY effective_from DESC NULLS LAST, recorded_at DESC
+			LIMIT 1
+		), applicants.marital_status)`
+
+// GET request for an applicant's marital status history, oldest first
+func GetMaritalStatusHistory(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := fetchMaritalStatusHistory(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching marital status history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, history)
+}
+
+// PUT request to change an applicant's marital status from a date
+// - Marrying another applicant (spouse_id) links the two as spouses and marks both as married
+// - Leaving a marriage removes the spouse links, and a divorce also marks the former spouse as divorced
+func UpdateMaritalStatus(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var change models.MaritalStatusChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !utils.IsValidMaritalStatus(change.MaritalStatus) {
+		http.Error(w, "marital_status must be one of single, married, widowed or divorced", http.StatusBadRequest)
+		return
+	}
+	if change.SpouseID != nil && change.MaritalStatus != "married" {
+		http.Error(w, "spouse_id can only be given when marrying", http.StatusBadRequest)
+		return
+	}
+	if change.SpouseID != nil && *change.SpouseID == applicantID {
+		http.Error(w, "an applicant cannot marry themselves", http.StatusBadRequest)
+		return
+	}
+
+	// The change takes effect today unless a date is given
+	effectiveFrom := time.Now().Format(utils.DateLayout)
+	if change.EffectiveFrom != nil {
+		effectiveFrom = *change.EffectiveFrom
+	}
+	if _, err := time.Parse(utils.DateLayout, effectiveFrom); err != nil {
+		http.Error(w, "effective_from must be in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	// Start a transaction so that both spouses are updated together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the applicant and fetch their current status
+	var currentStatus string
+	err = tx.QueryRow(`SELECT marital_status FROM applicants WHERE id = $1 FOR UPDATE`, applicantID).Scan(&currentStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if currentStatus == "married" && change.MaritalStatus == "single" {
+		http.Error(w, "a married applicant can only become divorced or widowed", http.StatusBadRequest)
+		return
+	}
+
+	// Fetch the applicant's current spouses from their household links
+	currentSpouses, err := fetchSpouses(tx, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching spouse: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if change.MaritalStatus == "married" {
+		// Marrying someone new means leaving the current marriage first
+		if change.SpouseID != nil && len(currentSpouses) > 0 && currentSpouses[0] != *change.SpouseID {
+			http.Error(w, "applicant is already married to another applicant", http.StatusConflict)
+			return
+		}
+
+		if change.SpouseID != nil {
+			// Lock the spouse, and check they are free to marry
+			var spouseStatus string
+			err = tx.QueryRow(`SELECT marital_status FROM applicants WHERE id = $1 FOR UPDATE`, *change.SpouseID).Scan(&spouseStatus)
+			if err == sql.ErrNoRows {
+				http.Error(w, "spouse not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error fetching spouse: %v", err), http.StatusInternalServerError)
+				return
+			}
+			spouseSpouses, err := fetchSpouses(tx, *change.SpouseID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error fetching spouse: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if len(spouseSpouses) > 0 && spouseSpouses[0] != applicantID {
+				http.Error(w, "spouse is already married to another applicant", http.StatusConflict)
+				return
+			}
+
+			// A household member already related another way, e.g. a child, cannot become the spouse
+			var otherwiseRelated bool
+			err = tx.QueryRow(`
+				SELECT EXISTS (
+					SELECT 1 FROM relations
+					WHERE ((id1 = $1 AND id2 = $2) OR (id1 = $2 AND id2 = $1)) AND relation <> 'spouse'
+				)`, applicantID, *change.SpouseID).Scan(&otherwiseRelated)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error fetching spouse: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if otherwiseRelated {
+				http.Error(w, "spouse is already related to the applicant in another way", http.StatusConflict)
+				return
+			}
+
+			// Link the two as spouses in both directions
+			_, err = tx.Exec(`
+				INSERT INTO relations (id1, id2, relation)
+				VALUES ($1, $2, 'spouse'), ($2, $1, 'spouse')
+				ON CONFLICT (id1, id2) DO NOTHING`, applicantID, *change.SpouseID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error linking spouse: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			spouseID := applicantID
+			err = recordMaritalStatus(tx, *change.SpouseID, "married", &spouseID, effectiveFrom)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error updating spouse: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+	} else {
+		// Leaving a marriage removes the spouse links
+		_, err = tx.Exec(`DELETE FROM relations WHERE relation = 'spouse' AND (id1 = $1 OR id2 = $1)`, applicantID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error unlinking spouse: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// A divorce applies to both spouses, while being widowed means the spouse has passed away
+		if change.MaritalStatus == "divorced" {
+			for _, spouseID := range currentSpouses {
+				err = recordMaritalStatus(tx, spouseID, "divorced", nil, effectiveFrom)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error updating spouse: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
+	err = recordMaritalStatus(tx, applicantID, change.MaritalStatus, change.SpouseID, effectiveFrom)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating marital status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Commit the transaction to save all the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Marital status updated successfully"))
+}
+
+// Add a marital status to an applicant's history, and make it their current status if it has taken effect
+// - A change dated in the future is picked up by currentMaritalStatus once its day comes
+func recordMaritalStatus(tx *sql.Tx, applicantID, status string, spouseID *string, effectiveFrom string) error {
+	if effectiveFrom <= time.Now().Format(utils.DateLayout) {
+		_, err := tx.Exec(`UPDATE applicants SET marital_status = $1 WHERE id = $2`, status, applicantID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO marital_status_history (id, applicant_id, marital_status, spouse_id, effective_from)
+		VALUES ($1, $2, $3, $4, $5)`,
+		uuid.New().String(), applicantID, status, spouseID, effectiveFrom)
+	return err
+}
+
+// Fetch the IDs of the applicants linked to an applicant as their spouse
+func fetchSpouses(tx *sql.Tx, applicantID string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT id2 FROM relations WHERE id1 = $1 AND relation = 'spouse'
+		UNION SELECT id1 FROM relations WHERE id2 = $1 AND relation = 'spouse'`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spouses []string
+	for rows.Next() {
+		var spouseID string
+		if err := rows.Scan(&spouseID); err != nil {
+			return nil, err
+		}
+		spouses = append(spouses, spouseID)
+	}
+	return spouses, rows.Err()
+}
+
+// Fetch an applicant's marital status history, oldest first
+func fetchMaritalStatusHistory(applicantID string) ([]models.MaritalStatusChange, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, applicant_id, marital_status, spouse_id, effective_from, recorded_at
+		FROM marital_status_history
+		WHERE applicant_id = $1
+		ORDER BY effective_from NULLS FIRST, recorded_at`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.MaritalStatusChange{}
+	for rows.Next() {
+		var change models.MaritalStatusChange
+		var spouseID sql.NullString
+		var effectiveFrom sql.NullTime
+		err := rows.Scan(&change.ID, &change.ApplicantID, &change.MaritalStatus, &spouseID, &effectiveFrom, &change.RecordedAt)
+		if err != nil {
+			return nil, err
+		}
+		if spouseID.Valid {
+			change.SpouseID = &spouseID.String
+		}
+		if effectiveFrom.Valid {
+			date := effectiveFrom.Time.Format(utils.DateLayout)
+			change.EffectiveFrom = &date
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
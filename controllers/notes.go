@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for an application's notes, oldest first, optionally filtered by ?visibility=
+func GetNotes(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	where := `WHERE application_id = $1`
+	values := []interface{}{applicationID}
+	if visibility := r.URL.Query().Get("visibility"); visibility != "" {
+		values = append(values, visibility)
+		where += ` AND visibility = $2`
+	}
+
+	notes, err := fetchNotes(where, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching notes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, notes)
+}
+
+// POST request to add a note to an application
+// - The X-User header is recorded as the author
+// - Notes are internal unless shared with the applicant
+func CreateNote(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["id"]
+
+	var note models.Note
+	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if note.Body == "" {
+		http.Error(w, "body is required", http.StatusBadRequest)
+		return
+	}
+	if note.Visibility == "" {
+		note.Visibility = "internal"
+	}
+	if note.Visibility != "internal" && note.Visibility != "applicant" {
+		http.Error(w, "visibility must be internal or applicant", http.StatusBadRequest)
+		return
+	}
+	note.Author = utils.RequestUser(r)
+	if note.Author == "" {
+		http.Error(w, fmt.Sprintf("the %s header is required to record who wrote the note", utils.UserHeader), http.StatusBadRequest)
+		return
+	}
+	if !applicationExists(w, applicationID) {
+		return
+	}
+
+	note.ID = uuid.New().String()
+	note.ApplicationID = applicationID
+	err := database.DB.QueryRow(`
+		INSERT INTO application_notes (id, application_id, author, body, visibility) VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`, note.ID, note.ApplicationID, note.Author, note.Body, note.Visibility).Scan(&note.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating note: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, note)
+}
+
+// Check that an application exists, writing the error response if it does not
+func applicationExists(w http.ResponseWriter, applicationID string) bool {
+	var exists bool
+	err := database.DB.QueryRow(`SELECT TRUE FROM applications WHERE id::text = $1`, applicationID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching application: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// Fetch notes matching a WHERE clause, oldest first
+func fetchNotes(where string, args ...interface{}) ([]models.Note, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, application_id, author, body, visibility, created_at
+		FROM application_notes `+where+`
+		ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []models.Note{}
+	for rows.Next() {
+		var note models.Note
+		if err := rows.Scan(&note.ID, &note.ApplicationID, &note.Author, &note.Body, &note.Visibility, &note.CreatedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+
+	"github.com/google/uuid"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/notifications"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// Phone numbers in international format, with an optional leading +
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{8,15}$`)
+
+// GET request for how an applicant is contacted
+// - Applicants who have not given any details are written to in English, and cannot be reached
+func GetApplicantContact(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	contact, err := fetchApplicantContact(applicantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching contact details: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, contact)
+}
+
+// PUT request to change how an applicant is contacted
+// - Fields that are left out are kept as they are, and an empty email or phone removes it
+func UpdateApplicantContact(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var update models.ApplicantContact
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	contact, err := fetchApplicantContact(applicantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching contact details: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if update.Email != nil {
+		contact.Email = update.Email
+		if *update.Email == "" {
+			contact.Email = nil
+		} else if _, err := mail.ParseAddress(*update.Email); err != nil {
+			http.Error(w, "email is not a valid email address", http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Phone != nil {
+		contact.Phone = update.Phone
+		if *update.Phone == "" {
+			contact.Phone = nil
+		} else if !phonePattern.MatchString(*update.Phone) {
+			http.Error(w, "phone must be 8 to 15 digits, optionally starting with +", http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Language != "" {
+		if !notifications.IsLanguage(update.Language) {
+			http.Error(w, fmt.Sprintf("language must be one of %v", notifications.Languages), http.StatusBadRequest)
+			return
+		}
+		contact.Language = update.Language
+	}
+
+	// Contact details are personal data, so they are encrypted like the applicant's other fields
+	var encryptedEmail, encryptedPhone *string
+	for _, field := range []struct{ plain, encrypted **string }{{&contact.Email, &encryptedEmail}, {&contact.Phone, &encryptedPhone}} {
+		if *field.plain == nil {
+			continue
+		}
+		encrypted, err := encryption.Encrypt(**field.plain)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting contact details: %v", err), http.StatusInternalServerError)
+			return
+		}
+		*field.encrypted = &encrypted
+	}
+
+	err = database.DB.QueryRow(`
+		INSERT INTO applicant_contacts (applicant_id, email, phone, language) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (applicant_id) DO UPDATE SET
+			email = EXCLUDED.email, phone = EXCLUDED.phone, language = EXCLUDED.language, updated_at = NOW()
+		RETURNING updated_at`, applicantID, encryptedEmail, encryptedPhone, contact.Language).Scan(&contact.UpdatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving contact details: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, contact)
+}
+
+// GET request for the notifications sent to an applicant, newest first
+func GetApplicantNotifications(w http.ResponseWriter, r *http.Request) {
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	notifications, err := fetchNotifications(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching notifications: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, notifications)
+}
+
+// Queue a notification to the applicant about their application's new status, if they are told about it
+func queueStatusNotification(tx *sql.Tx, applicationID, status string) error {
+	event := "application." + status
+	if !notifications.HasTemplate(event) {
+		return nil
+	}
+
+	var applicantID, schemeName string
+	err := tx.QueryRow(`
+		SELECT applications.applicant_id, schemes.name
+		FROM applications JOIN schemes ON schemes.id = applications.scheme_id
+		WHERE applications.id = $1`, applicationID).Scan(&applicantID, &schemeName)
+	if err != nil {
+		return err
+	}
+	return queueNotification(tx, applicantID, &applicationID, event, schemeName)
+}
+
+// Queue a notification to an applicant about a scheme, and their application to it if there is one
+// - It is sent by email and by SMS, to whichever of them the applicant has given
+func queueNotification(tx *sql.Tx, applicantID string, applicationID *string, event, schemeName string) error {
+	var encryptedName, language string
+	var email, phone sql.NullString
+	err := tx.QueryRow(`
+		SELECT applicants.name, applicant_contacts.email, applicant_contacts.phone, COALESCE(applicant_contacts.language, $2)
+		FROM applicants LEFT JOIN applicant_contacts ON applicant_contacts.applicant_id = applicants.id
+		WHERE applicants.id = $1`, applicantID, notifications.DefaultLanguage).
+		Scan(&encryptedName, &email, &phone, &language)
+	if err != nil {
+		return err
+	}
+	name, err := encryption.Decrypt(encryptedName)
+	if err != nil {
+		return err
+	}
+	data := notifications.Data{ApplicantName: name, SchemeName: schemeName}
+	if applicationID != nil {
+		data.ApplicationID = *applicationID
+	}
+
+	queued := false
+	for _, recipient := range []struct {
+		channel string
+		address sql.NullString
+	}{{notifications.Email, email}, {notifications.SMS, phone}} {
+		if !recipient.address.Valid {
+			continue
+		}
+		subject, body, err := notifications.Render(event, language, recipient.channel, data)
+		if err != nil {
+			return err
+		}
+		// The message names the applicant, so it is kept encrypted like their other personal fields
+		if subject, err = encryption.Encrypt(subject); err != nil {
+			return err
+		}
+		if body, err = encryption.Encrypt(body); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO notifications (id, applicant_id, application_id, event, channel, language, recipient, subject, body)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			uuid.New().String(), applicantID, applicationID, event, recipient.channel, language, recipient.address.String, subject, body)
+		if err != nil {
+			return err
+		}
+		queued = true
+	}
+
+	// Keep a record that the applicant was not told, so that caseworkers can follow up
+	if !queued {
+		_, err = tx.Exec(`
+			INSERT INTO notifications (id, applicant_id, application_id, event, language, status, error)
+			VALUES ($1, $2, $3, $4, $5, 'skipped', 'applicant has no email or phone number')`,
+			uuid.New().String(), applicantID, applicationID, event, language)
+	}
+	return err
+}
+
+// Fetch an applicant's contact details, with the defaults if they have not given any
+// - Returns sql.ErrNoRows if the applicant does not exist
+func fetchApplicantContact(applicantID string) (models.ApplicantContact, error) {
+	contact := models.ApplicantContact{ApplicantID: applicantID, Language: notifications.DefaultLanguage}
+	var email, phone sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT applicant_contacts.email, applicant_contacts.phone, COALESCE(applicant_contacts.language, $2), applicant_contacts.updated_at
+		FROM applicants LEFT JOIN applicant_contacts ON applicant_contacts.applicant_id = applicants.id
+		WHERE applicants.id::text = $1`, applicantID, notifications.DefaultLanguage).
+		Scan(&email, &phone, &contact.Language, &contact.UpdatedAt)
+	if err != nil {
+		return contact, err
+	}
+	if contact.Email, err = decryptNullString(email); err != nil {
+		return contact, err
+	}
+	contact.Phone, err = decryptNullString(phone)
+	return contact, err
+}
+
+// Fetch the notifications sent to an applicant, newest first
+func fetchNotifications(applicantID string) ([]models.Notification, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, applicant_id, application_id, event, channel, language, recipient, subject, body, status, error, created_at, sent_at
+		FROM notifications
+		WHERE applicant_id::text = $1
+		ORDER BY created_at DESC, id`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var notification models.Notification
+		var recipient sql.NullString
+		err := rows.Scan(&notification.ID, &notification.ApplicantID, &notification.ApplicationID, &notification.Event,
+			&notification.Channel, &notification.Language, &recipient, &notification.Subject, &notification.Body,
+			&notification.Status, &notification.Error, &notification.CreatedAt, &notification.SentAt)
+		if err != nil {
+			return nil, err
+		}
+		if notification.Recipient, err = decryptNullString(recipient); err != nil {
+			return nil, err
+		}
+		if notification.Subject, err = encryption.Decrypt(notification.Subject); err != nil {
+			return nil, err
+		}
+		if notification.Body, err = encryption.Decrypt(notification.Body); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+// Decrypt a value that may be NULL
+func decryptNullString(value sql.NullString) (*string, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	decrypted, err := encryption.Decrypt(value.String)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
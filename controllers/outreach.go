@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/notifications"
+	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
+)
+
+const (
+	outreachPollInterval = 10 * time.Second
+	// A job left running this long is assumed to have been abandoned by an instance that stopped, and is run again
+	outreachJobTimeout = time.Hour
+)
+
+// POST request to look for applicants who qualify for a scheme but have not applied to it
+// - The search runs in the background, and its progress can be followed through GET /api/outreach/jobs
+func StartOutreach(w http.ResponseWriter, r *http.Request) {
+	schemeID := mux.Vars(r)["id"]
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT TRUE FROM schemes WHERE id::text = $1`, schemeID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jobID, err := queueOutreach(tx, schemeID, "manual")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error queueing outreach: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jobs, err := fetchOutreachJobs(`WHERE id = $1`, jobID)
+	if err != nil || len(jobs) == 0 {
+		http.Error(w, fmt.Sprintf("Error fetching outreach job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusAccepted, jobs[0])
+}
+
+// GET request for outreach jobs, newest first, optionally filtered by ?scheme=
+func GetOutreachJobs(w http.ResponseWriter, r *http.Request) {
+	where := `WHERE TRUE`
+	values := []interface{}{}
+	if schemeID := r.URL.Query().Get("scheme"); schemeID != "" {
+		values = append(values, schemeID)
+		where += ` AND scheme_id::text = $1`
+	}
+
+	jobs, err := fetchOutreachJobs(where, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching outreach jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, jobs)
+}
+
+// GET request for the applicants found to qualify for schemes they had not applied to, newest first
+// - Optionally filtered by ?scheme= and ?applicant=
+func GetOutreachMatches(w http.ResponseWriter, r *http.Request) {
+	where := `WHERE TRUE`
+	values := []interface{}{}
+	for _, filter := range []struct{ param, column string }{{"scheme", "scheme_id"}, {"applicant", "applicant_id"}} {
+		if value := r.URL.Query().Get(filter.param); value != "" {
+			values = append(values, value)
+			where += fmt.Sprintf(" AND %s::text = $%d", filter.column, len(values))
+		}
+	}
+
+	matches, err := fetchOutreachMatches(where, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching outreach matches: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, matches)
+}
+
+// Queue a search for applicants who qualify for a scheme, as part of the transaction that changed the scheme
+// - The search only starts once the transaction commits
+// - It waits until the scheme accepts applications and its latest version takes effect, so applicants are checked against what they can apply for
+// - A scheme that will not accept applications again is searched straight away, and the job is skipped
+func queueOutreach(tx *sql.Tx, schemeID, reason string) (string, error) {
+	rows, err := tx.Query(`
+		SELECT scheme_versions.effective_from, `+schemeWindowColumns+`
+		FROM schemes JOIN scheme_versions ON scheme_versions.scheme_id = schemes.id AND scheme_versions.effective_to IS NULL
+		WHERE schemes.id = $1`, schemeID)
+	if err != nil {
+		return "", err
+	}
+	var effectiveFrom time.Time
+	var window models.SchemeWindow
+	if rows.Next() {
+		window, err = scanSchemeWindow(rows, &effectiveFrom)
+	}
+	rows.Close()
+	if err != nil {
+		return "", err
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	var runAfter *time.Time
+	if opening := nextOpening(window, time.Now()); opening != nil {
+		runAfter = opening
+		if effectiveFrom.After(*opening) {
+			runAfter = &effectiveFrom
+		}
+	}
+
+	jobID := uuid.New().String()
+	_, err = tx.Exec(`INSERT INTO outreach_jobs (id, scheme_id, reason, run_after) VALUES ($1, $2, $3, GREATEST(NOW(), COALESCE($4, NOW())))`,
+		jobID, schemeID, reason, runAfter)
+	return jobID, err
+}
+
+// Start running queued outreach jobs in the background, one at a time
+func StartOutreachJobs() {
+	go func() {
+		ticker := time.NewTicker(outreachPollInterval)
+		defer ticker.Stop()
+		for {
+			for {
+				ran, err := runNextOutreachJob()
+				if err != nil {
+					log.Printf("Error running outreach job: %v", err)
+				}
+				if !ran {
+					break
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Claim the oldest queued job and run it, returning false if there was none
+func runNextOutreachJob() (bool, error) {
+	var jobID, schemeID string
+	err := database.DB.QueryRow(`
+		UPDATE outreach_jobs SET status = 'running', started_at = NOW()
+		WHERE id = (
+			SELECT id FROM outreach_jobs
+			WHERE (status = 'pending' AND run_after <= NOW()) OR (status = 'running' AND started_at < NOW() - $1 * INTERVAL '1 second')
+			ORDER BY run_after, created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, scheme_id`, outreachJobTimeout.Seconds()).Scan(&jobID, &schemeID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	status, checked, matches, runErr := runOutreachJob(jobID, schemeID)
+	var errorMessage *string
+	if runErr != nil {
+		status = "failed"
+		message := runErr.Error()
+		errorMessage = &message
+	}
+	_, err = database.DB.Exec(`
+		UPDATE outreach_jobs SET status = $1, applicants_checked = $2, matches = $3, error = $4, finished_at = NOW()
+		WHERE id = $5`, status, checked, matches, errorMessage, jobID)
+	return true, err
+}
+
+// Check every applicant who has not applied to or been matched to the scheme, and match those who qualify for it today
+// - Uses the same eligibility as GET /api/schemes/eligible, so applicants whose grants rule the scheme out are left alone
+// - Anonymised applicants are left alone, as they can no longer be contacted
+// - Returns the job's final status, how many applicants were checked, and how many were matched
+func runOutreachJob(jobID, schemeID string) (string, int, int, error) {
+	window, err := fetchSchemeWindow(schemeID)
+	if err == sql.ErrNoRows {
+		return "skipped", 0, 0, nil
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	now := time.Now()
+	if !acceptsApplications(window, now) {
+		return "skipped", 0, 0, nil
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id FROM applicants
+		WHERE anonymised_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM applications WHERE applicant_id = applicants.id AND scheme_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM outreach_matches WHERE applicant_id = applicants.id AND scheme_id = $1)
+		ORDER BY id`, schemeID)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	applicantIDs := []string{}
+	for rows.Next() {
+		var applicantID string
+		if err := rows.Scan(&applicantID); err != nil {
+			rows.Close()
+			return "", 0, 0, err
+		}
+		applicantIDs = append(applicantIDs, applicantID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return "", 0, 0, err
+	}
+
+	checked, matches := 0, 0
+	for _, applicantID := range applicantIDs {
+		// One applicant whose records cannot be assessed should not stop everyone after them being checked
+		schemes, err := fetchEligibleSchemes(applicantID, now, nil)
+		if err != nil {
+			log.Printf("Error checking applicant %s for outreach job %s: %v", applicantID, jobID, err)
+			continue
+		}
+		checked++
+
+		for _, scheme := range schemes {
+			if scheme.ID != schemeID || scheme.AcceptingApplications == nil || !*scheme.AcceptingApplications || scheme.ExcludedBy != nil {
+				continue
+			}
+			matched, err := recordOutreachMatch(jobID, applicantID, scheme)
+			if err != nil {
+				return "", checked, matches, fmt.Errorf("matching applicant %s: %v", applicantID, err)
+			}
+			if matched {
+				matches++
+			}
+		}
+	}
+	return "done", checked, matches, nil
+}
+
+// Record that an applicant qualifies for a scheme, and tell them and any webhook subscribers
+// - Returns false if they had already been matched to the scheme, in which case nobody is told again
+func recordOutreachMatch(jobID, applicantID string, scheme models.Scheme) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	match := models.OutreachMatch{ID: uuid.New().String(), ApplicantID: applicantID, SchemeID: scheme.ID, VersionID: scheme.VersionID, JobID: jobID}
+	err = tx.QueryRow(`
+		INSERT INTO outreach_matches (id, applicant_id, scheme_id, version_id, job_id) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (applicant_id, scheme_id) DO NOTHING
+		RETURNING matched_at`, match.ID, match.ApplicantID, match.SchemeID, match.VersionID, match.JobID).Scan(&match.MatchedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err = queueNotification(tx, applicantID, nil, notifications.SchemeEligible, scheme.Name); err != nil {
+		return false, err
+	}
+	if err = webhooks.Enqueue(tx, webhooks.OutreachMatched, match); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Fetch outreach jobs matching a WHERE clause, newest first
+func fetchOutreachJobs(where string, args ...interface{}) ([]models.OutreachJob, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, scheme_id, reason, status, applicants_checked, matches, error, created_at, run_after, started_at, finished_at
+		FROM outreach_jobs `+where+`
+		ORDER BY created_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.OutreachJob{}
+	for rows.Next() {
+		var job models.OutreachJob
+		err := rows.Scan(&job.ID, &job.SchemeID, &job.Reason, &job.Status, &job.ApplicantsChecked, &job.Matches, &job.Error,
+			&job.CreatedAt, &job.RunAfter, &job.StartedAt, &job.FinishedAt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Fetch outreach matches matching a WHERE clause, newest first
+func fetchOutreachMatches(where string, args ...interface{}) ([]models.OutreachMatch, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, applicant_id, scheme_id, version_id, job_id, matched_at FROM outreach_matches `+where+`
+		ORDER BY matched_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []models.OutreachMatch{}
+	for rows.Next() {
+		var match models.OutreachMatch
+		if err := rows.Scan(&match.ID, &match.ApplicantID, &match.SchemeID, &match.VersionID, &match.JobID, &match.MatchedAt); err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
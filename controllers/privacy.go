@@ -0,0 +1,325 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request to export everything held about one applicant (subject access request)
+func ExportApplicant(w http.ResponseWriter, r *http.Request) {
+	// Extract applicant ID from URL
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	export := models.ApplicantExport{
+		ExportedAt:   time.Now().UTC().Format(time.RFC3339),
+		Relations:    []models.Relation{},
+		Applications: []models.Application{},
+	}
+
+	// Fetch the applicant's profile
+	query := `
+		SELECT id, name, employment_status, sex, date_of_birth, COALESCE(national_id, ''), ` + currentMaritalStatus + `,
+			education_level_override, anonymised_at
+		FROM applicants WHERE id = $1`
+	var anonymisedAt sql.NullString
+	err := database.DB.QueryRow(query, applicantID).Scan(&export.Applicant.ID, &export.Applicant.Name,
+		&export.Applicant.EmploymentStatus, &export.Applicant.Sex, &export.Applicant.DateOfBirth,
+		&export.Applicant.NationalID, &export.Applicant.MaritalStatus, &export.Applicant.EducationLevelOverride, &anonymisedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if anonymisedAt.Valid {
+		export.Applicant.AnonymisedAt = &anonymisedAt.String
+	}
+	if err := decryptApplicant(&export.Applicant); err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the household links in both directions
+	rows, err := database.DB.Query(`SELECT id1, id2, relation FROM relations WHERE id1 = $1 OR id2 = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching relations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var relation models.Relation
+		if err := rows.Scan(&relation.ID1, &relation.ID2, &relation.Relation); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning relation: %v", err), http.StatusInternalServerError)
+			return
+		}
+		export.Relations = append(export.Relations, relation)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating relations: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the applications made by the applicant
+	rows, err = database.DB.Query(`SELECT id, applicant_id, scheme_id, status, as_of, scheme_version_id, decided_at, decided_by FROM applications WHERE applicant_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var application models.Application
+		var asOf time.Time
+		var schemeVersionID, decidedAt sql.NullString
+		err := rows.Scan(&application.ID, &application.ApplicantID, &application.SchemeID, &application.Status, &asOf, &schemeVersionID,
+			&decidedAt, &application.DecidedBy)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning application: %v", err), http.StatusInternalServerError)
+			return
+		}
+		application.AsOf = asOf.Format(utils.DateLayout)
+		application.SchemeVersionID = schemeVersionID.String
+		if decidedAt.Valid {
+			application.DecidedAt = &decidedAt.String
+		}
+		export.Applications = append(export.Applications, application)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating applications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	applicationIDs := make([]string, len(export.Applications))
+	for i, application := range export.Applications {
+		applicationIDs[i] = application.ID
+	}
+	beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(database.DB, applicationIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching beneficiaries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i, application := range export.Applications {
+		export.Applications[i].Beneficiaries = beneficiariesByApplicationID[application.ID]
+	}
+
+	// Fetch the applicant's financial records
+	export.FinancialRecords, err = fetchFinancialRecords(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching financial records: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the applicant's marital status history
+	export.MaritalStatusHistory, err = fetchMaritalStatusHistory(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching marital status history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the audit trail: every status change to the applicant's applications, and the merges they were part of
+	export.StatusHistory, err = fetchStatusHistory(
+		`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching status history: %v", err), http.StatusInternalServerError)
+		return
+	}
+	export.Merges, err = fetchApplicantMerges(`WHERE survivor_id = $1 OR merged_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching merges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the appeals against the applicant's applications
+	export.Appeals, err = fetchAppeals(`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching appeals: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the notes shared with the applicant, and the files attached to their applications
+	export.Notes, err = fetchNotes(
+		`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1) AND visibility = 'applicant'`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching notes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	export.Attachments, err = fetchAttachments(`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch how the applicant is contacted, and what they have been sent
+	contact, err := fetchApplicantContact(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching contact details: %v", err), http.StatusInternalServerError)
+		return
+	}
+	export.Contact = &contact
+	export.Notifications, err = fetchNotifications(applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching notifications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	export.OutreachMatches, err = fetchOutreachMatches(`WHERE applicant_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching outreach matches: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the payments made or scheduled under the applicant's applications, or for them as a beneficiary
+	export.Disbursements, err = fetchDisbursements(
+		`WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1) OR beneficiary_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching disbursements: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Serve the export as a downloadable file
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"applicant-%s.json\"", applicantID))
+	utils.SendJSONResponse(w, http.StatusOK, export)
+}
+
+// POST request to scrub an applicant's identifying fields
+// - Household links and applications are kept so that aggregate statistics stay intact
+func AnonymiseApplicant(w http.ResponseWriter, r *http.Request) {
+	// Extract applicant ID from URL
+	applicantID := r.URL.Query().Get("applicant")
+	if applicantID == "" {
+		http.Error(w, "applicant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Start a transaction so that the applicant cannot change while we scrub it
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var encryptedDOB string
+	var anonymisedAt sql.NullString
+	err = tx.QueryRow(`SELECT date_of_birth, anonymised_at FROM applicants WHERE id = $1 FOR UPDATE`, applicantID).Scan(&encryptedDOB, &anonymisedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "applicant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if anonymisedAt.Valid {
+		http.Error(w, "applicant has already been anonymised", http.StatusConflict)
+		return
+	}
+
+	// Keep only the year of birth so that age bands remain reportable
+	dob, err := encryption.Decrypt(encryptedDOB)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	parsedDOB, err := time.Parse(utils.DateLayout, dob)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing date of birth: %v", err), http.StatusInternalServerError)
+		return
+	}
+	yearOfBirth := time.Date(parsedDOB.Year(), time.January, 1, 0, 0, 0, 0, time.UTC).Format(utils.DateLayout)
+
+	anonymisedName, err := encryption.Encrypt("Anonymised applicant")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	anonymisedDOB, err := encryption.Encrypt(yearOfBirth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Replace the name, remove the national ID, and clear the blind indexes so the applicant can no longer be looked up
+	query := `
+		UPDATE applicants
+		SET name = $1, name_index = NULL, date_of_birth = $2, national_id = NULL, national_id_index = NULL, anonymised_at = NOW()
+		WHERE id = $3`
+	_, err = tx.Exec(query, anonymisedName, anonymisedDOB, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error anonymising applicant: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Forget how to reach them, and scrub the messages they were sent, which carry their name
+	_, err = tx.Exec(`DELETE FROM applicant_contacts WHERE applicant_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting contact details: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`UPDATE notifications SET recipient = NULL, subject = '', body = '' WHERE applicant_id = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error scrubbing notifications: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Take them out of the duplicate review queue, which can no longer be acted on
+	_, err = tx.Exec(`DELETE FROM duplicate_candidates WHERE applicant_id1 = $1 OR applicant_id2 = $1`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting duplicate candidates: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Remove the files attached to their applications, such as payslips, and redact the notes written about them
+	rows, err := tx.Query(`
+		DELETE FROM application_attachments
+		WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)
+		RETURNING storage_key`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			http.Error(w, fmt.Sprintf("Error scanning attachment: %v", err), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating attachments: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE application_notes SET body = 'Redacted when the applicant was anonymised'
+		WHERE application_id IN (SELECT id FROM applications WHERE applicant_id = $1)`, applicantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error redacting notes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Commit the transaction to save the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deleteBlobs(keys)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Applicant anonymised successfully"))
+}
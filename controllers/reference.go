@@ -0,0 +1,13 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/neozhixuan/gt_assessment/config"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for the education levels that applicants and scheme criteria share
+func GetEducationLevels(w http.ResponseWriter, r *http.Request) {
+	utils.SendJSONResponse(w, http.StatusOK, config.EducationLevels)
+}
@@ -0,0 +1,361 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// GET request for every scheme group with its schemes
+func GetSchemeGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := fetchSchemeGroups(`TRUE`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme groups: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, groups)
+}
+
+// POST request to create a scheme group
+func CreateSchemeGroup(w http.ResponseWriter, r *http.Request) {
+	var group models.SchemeGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	group.ID = uuid.New().String()
+	saveSchemeGroup(w, group, http.StatusCreated)
+}
+
+// PUT request to replace a scheme group's rules and schemes
+func UpdateSchemeGroup(w http.ResponseWriter, r *http.Request) {
+	var group models.SchemeGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	group.ID = mux.Vars(r)["id"]
+
+	var exists bool
+	err := database.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM scheme_groups WHERE id = $1)`, group.ID).Scan(&exists)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme group: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "scheme group not found", http.StatusNotFound)
+		return
+	}
+	saveSchemeGroup(w, group, http.StatusOK)
+}
+
+// DELETE request for a scheme group
+// - Existing grants are kept, the group's rules just stop applying
+func DeleteSchemeGroup(w http.ResponseWriter, r *http.Request) {
+	_, err := database.DB.Exec(`DELETE FROM scheme_groups WHERE id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting scheme group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Scheme group deleted successfully"))
+}
+
+// Validate a scheme group, then insert or replace it along with its schemes
+func saveSchemeGroup(w http.ResponseWriter, group models.SchemeGroup, status int) {
+	if err := validateSchemeGroup(&group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Start a transaction so that the group and its schemes are saved together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO scheme_groups (id, name, exclusive, max_combined_amount, currency, period_months)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, exclusive = EXCLUDED.exclusive,
+			max_combined_amount = EXCLUDED.max_combined_amount, currency = EXCLUDED.currency, period_months = EXCLUDED.period_months`,
+		group.ID, group.Name, group.Exclusive, group.MaxCombinedAmount, group.Currency, group.PeriodMonths)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving scheme group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM scheme_group_members WHERE group_id = $1`, group.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unlinking schemes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, schemeID := range group.SchemeIDs {
+		_, err = tx.Exec(`INSERT INTO scheme_group_members (group_id, scheme_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			group.ID, schemeID)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, fmt.Sprintf("scheme %s not found", schemeID), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error linking scheme: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Commit the transaction to save all the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, status, group)
+}
+
+// Check a scheme group's rules, defaulting its currency
+func validateSchemeGroup(group *models.SchemeGroup) error {
+	if group.Name == "" {
+		return errors.New("scheme group name is required")
+	}
+	if len(group.SchemeIDs) < 2 {
+		return errors.New("a scheme group needs at least 2 schemes")
+	}
+	if !group.Exclusive && group.MaxCombinedAmount == nil {
+		return errors.New("a scheme group must be exclusive, have a max_combined_amount, or both")
+	}
+	if group.MaxCombinedAmount != nil && *group.MaxCombinedAmount < 0 {
+		return errors.New("max_combined_amount cannot be negative")
+	}
+	if group.Currency == "" {
+		group.Currency = models.DefaultCurrency
+	}
+	if !utils.IsValidCurrencyCode(group.Currency) {
+		return errors.New("currency must be a 3 letter ISO 4217 code, e.g. SGD")
+	}
+	if group.PeriodMonths != nil && *group.PeriodMonths < 1 {
+		return errors.New("period_months must be at least 1")
+	}
+	return nil
+}
+
+// Fetch the scheme groups matching a condition on scheme_groups, with their schemes
+func fetchSchemeGroups(condition string, args ...interface{}) ([]models.SchemeGroup, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, name, exclusive, max_combined_amount, currency, period_months,
+			ARRAY(SELECT scheme_id FROM scheme_group_members WHERE group_id = scheme_groups.id)
+		FROM scheme_groups
+		WHERE `+condition+`
+		ORDER BY name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.SchemeGroup{}
+	for rows.Next() {
+		var group models.SchemeGroup
+		var schemeIDs pq.StringArray
+		err := rows.Scan(&group.ID, &group.Name, &group.Exclusive, &group.MaxCombinedAmount, &group.Currency,
+			&group.PeriodMonths, &schemeIDs)
+		if err != nil {
+			return nil, err
+		}
+		group.SchemeIDs = schemeIDs
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// A scheme an applicant has been granted, and what has been paid or scheduled under it in each currency
+type grant struct {
+	applicationID string
+	schemeID      string
+	asOf          time.Time
+	totals        map[string]models.Money
+}
+
+// Fetch an applicant's approved applications, leaving out one application if it is being approved now
+func fetchGrants(applicantID, exceptApplicationID string) ([]grant, error) {
+	rows, err := database.DB.Query(`
+		SELECT applications.id, applications.scheme_id, applications.as_of, disbursements.currency, SUM(disbursements.amount)
+		FROM applications
+		LEFT JOIN disbursements ON disbursements.application_id = applications.id AND disbursements.status <> 'cancelled'
+		WHERE applications.applicant_id = $1 AND applications.status = 'approved' AND applications.id::text <> $2
+		GROUP BY applications.id, disbursements.currency`, applicantID, exceptApplicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []grant
+	byID := make(map[string]int)
+	for rows.Next() {
+		var g grant
+		var currency sql.NullString
+		var total *models.Money
+		if err := rows.Scan(&g.applicationID, &g.schemeID, &g.asOf, &currency, &total); err != nil {
+			return nil, err
+		}
+		i, ok := byID[g.applicationID]
+		if !ok {
+			g.totals = make(map[string]models.Money)
+			i = len(grants)
+			byID[g.applicationID] = i
+			grants = append(grants, g)
+		}
+		if currency.Valid && total != nil {
+			grants[i].totals[currency.String] = *total
+		}
+	}
+	return grants, rows.Err()
+}
+
+// Check whether granting a scheme on a date would break the rules of any group it is in
+// - entitlements are what the applicant would receive from the scheme
+// - Returns nil if the scheme can be granted
+func findGroupConflict(groups []models.SchemeGroup, grants []grant, schemeID string, asOf time.Time,
+	entitlements []models.Entitlement) *models.GroupConflict {
+	for _, group := range groups {
+		members := make(map[string]bool)
+		for _, id := range group.SchemeIDs {
+			members[id] = true
+		}
+		if !members[schemeID] {
+			continue
+		}
+
+		// Find the applicant's grants in this group that are within the group's period
+		var related []grant
+		for _, g := range grants {
+			if !members[g.schemeID] {
+				continue
+			}
+			if group.PeriodMonths != nil {
+				earliest := addMonths(asOf, -*group.PeriodMonths)
+				latest := addMonths(asOf, *group.PeriodMonths)
+				if !g.asOf.After(earliest) || !g.asOf.Before(latest) {
+					continue
+				}
+			}
+			related = append(related, g)
+		}
+		if len(related) == 0 {
+			continue
+		}
+
+		conflict := &models.GroupConflict{GroupID: group.ID, GroupName: group.Name}
+		for _, g := range related {
+			conflict.ApplicationIDs = append(conflict.ApplicationIDs, g.applicationID)
+		}
+		if group.Exclusive {
+			// Only grants of the other schemes exclude this one
+			for _, g := range related {
+				if g.schemeID != schemeID {
+					conflict.Reason = "the applicant has already been granted another scheme in this group"
+					return conflict
+				}
+			}
+		}
+
+		// Add up what has been paid across the group, and what this scheme would add
+		if group.MaxCombinedAmount != nil {
+			var combined models.Money
+			for _, g := range related {
+				combined += g.totals[group.Currency]
+			}
+			for _, entitlement := range entitlements {
+				if entitlement.Total != nil && entitlement.Currency == group.Currency {
+					combined += *entitlement.Total
+				}
+			}
+			if combined > *group.MaxCombinedAmount {
+				conflict.Reason = fmt.Sprintf("the combined benefits of %s %s would exceed the group's limit of %s %s",
+					group.Currency, combined, group.Currency, *group.MaxCombinedAmount)
+				return conflict
+			}
+		}
+	}
+	return nil
+}
+
+// Check that approving an application does not break the rules of its scheme's groups
+// - Returns the conflict if it does, and nil if it can be approved
+func checkApprovalAgainstGroups(tx *sql.Tx, applicationID string) (*models.GroupConflict, error) {
+	var applicantID, schemeID string
+	var versionID sql.NullString
+	var asOf time.Time
+	err := tx.QueryRow(`SELECT applicant_id, scheme_id, scheme_version_id, as_of FROM applications WHERE id = $1`, applicationID).
+		Scan(&applicantID, &schemeID, &versionID, &asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the applicant, so that two of their applications cannot be approved at the same time
+	_, err = tx.Exec(`SELECT 1 FROM applicants WHERE id = $1 FOR UPDATE`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := fetchSchemeGroups(`id IN (SELECT group_id FROM scheme_group_members WHERE scheme_id = $1)`, schemeID)
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+	grants, err := fetchGrants(applicantID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out what this application would pay
+	beneficiariesByApplicationID, err := fetchBeneficiariesByApplicationID(tx, []string{applicationID})
+	if err != nil {
+		return nil, err
+	}
+	applicant, err := fetchApplicantCircumstances(applicantID, asOf, beneficiaryIDs(beneficiariesByApplicationID[applicationID]))
+	if err != nil {
+		return nil, err
+	}
+	benefitsByVersionID, err := fetchBenefitsByVersionID([]string{versionID.String})
+	if err != nil {
+		return nil, err
+	}
+	var entitlements []models.Entitlement
+	for _, benefit := range benefitsByVersionID[versionID.String] {
+		entitlements = append(entitlements, computeEntitlement(benefit, applicant.ChildrenCount, applicant.Finances.HouseholdSize))
+	}
+
+	return findGroupConflict(groups, grants, schemeID, asOf, entitlements), nil
+}
+
+// Check an application being approved against its scheme's groups, writing the error response if it cannot be
+func approveWithinGroups(w http.ResponseWriter, tx *sql.Tx, applicationID string) bool {
+	conflict, err := checkApprovalAgainstGroups(tx, applicationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "application not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking scheme groups: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if conflict != nil {
+		http.Error(w, fmt.Sprintf("application cannot be approved under scheme group %s: %s", conflict.GroupName, conflict.Reason),
+			http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,578 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
+)
+
+// How often to check for scheme versions that have taken effect
+const versionPromotionInterval = time.Minute
+
+// Orders a scheme's versions so the one in effect today comes first
+// - A scheme whose first version has not started yet falls back to that version
+const currentVersionOrder = `(scheme_versions.effective_from > CURRENT_DATE), ABS(scheme_versions.effective_from - CURRENT_DATE)`
+
+// GET request for a scheme's versions, oldest first, with their criteria and benefits
+func GetSchemeVersions(w http.ResponseWriter, r *http.Request) {
+	schemeID := r.URL.Query().Get("scheme")
+	if schemeID == "" {
+		http.Error(w, "scheme ID is required", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := fetchSchemeVersions(schemeID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, versions)
+}
+
+// POST request to publish a new version of a scheme from its effective_from date
+// - The previous version ends the day the new one starts
+// - Applications already made stay pinned to the version they were assessed under
+func PublishSchemeVersion(w http.ResponseWriter, r *http.Request) {
+	schemeID := r.URL.Query().Get("scheme")
+	if schemeID == "" {
+		http.Error(w, "scheme ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var input models.SchemeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, fmt.Sprintf("Error payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateSchemeInput(&input); err != nil {
+		http.Error(w, err.Error(), schemeBenefitsStatus(err))
+		return
+	}
+
+	// Start a transaction so that the old version is closed and the new one opened together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the scheme's latest version
+	var latestID string
+	var latestVersion int
+	var latestFrom time.Time
+	err = tx.QueryRow(`
+		SELECT id, version, effective_from FROM scheme_versions
+		WHERE scheme_id = $1
+		ORDER BY version DESC
+		LIMIT 1
+		FOR UPDATE`, schemeID).Scan(&latestID, &latestVersion, &latestFrom)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching latest version: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Past versions are fixed, as applications assessed under them are pinned to them
+	if input.EffectiveFrom < time.Now().Format(utils.DateLayout) {
+		http.Error(w, "effective_from cannot be in the past", http.StatusBadRequest)
+		return
+	}
+
+	// Versions must follow each other, or a date could fall under two of them
+	if input.EffectiveFrom <= latestFrom.Format(utils.DateLayout) {
+		http.Error(w, fmt.Sprintf("effective_from must be after %s, when version %d started", latestFrom.Format(utils.DateLayout), latestVersion),
+			http.StatusBadRequest)
+		return
+	}
+
+	// 1. Close the latest version
+	_, err = tx.Exec(`UPDATE scheme_versions SET effective_to = $1 WHERE id = $2`, input.EffectiveFrom, latestID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error closing version %d: %v", latestVersion, err), http.StatusInternalServerError)
+		return
+	}
+
+	// 2. Insert the new version with its criteria and benefits
+	versionID, err := insertSchemeVersion(tx, schemeID, latestVersion+1, input)
+	if errors.Is(err, errBenefitRetired) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to insert scheme version: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 3. Make the new version the scheme's current name, criteria and benefits if it starts today
+	// - Versions starting later are promoted on the day they take effect, by StartVersionPromotion
+	if input.EffectiveFrom <= time.Now().Format(utils.DateLayout) {
+		if err = linkCurrentVersion(tx, schemeID, versionID); err != nil {
+			http.Error(w, fmt.Sprintf("Error linking scheme to version: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Look for applicants who qualify under the new version
+	if _, err = queueOutreach(tx, schemeID, "new_version"); err != nil {
+		http.Error(w, fmt.Sprintf("Error queueing outreach: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = webhooks.Enqueue(tx, webhooks.SchemeUpdated, models.SchemeUpdated{SchemeID: schemeID, VersionID: versionID}); err != nil {
+		http.Error(w, fmt.Sprintf("Error recording event: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Commit the transaction to save all the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	versions, err := fetchSchemeVersions(schemeID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusCreated, versions[len(versions)-1])
+}
+
+// GET request for what changed between two versions of a scheme
+func GetSchemeVersionDiff(w http.ResponseWriter, r *http.Request) {
+	schemeID := r.URL.Query().Get("scheme")
+	if schemeID == "" {
+		http.Error(w, "scheme ID is required", http.StatusBadRequest)
+		return
+	}
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "from and to version numbers are required", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := fetchSchemeVersions(schemeID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Find the two versions
+	var fromVersion, toVersion *models.SchemeVersion
+	for i := range versions {
+		if versions[i].Version == from {
+			fromVersion = &versions[i]
+		}
+		if versions[i].Version == to {
+			toVersion = &versions[i]
+		}
+	}
+	if fromVersion == nil || toVersion == nil {
+		http.Error(w, "scheme version not found", http.StatusNotFound)
+		return
+	}
+
+	diff := models.SchemeVersionDiff{
+		SchemeID:        schemeID,
+		FromVersion:     from,
+		ToVersion:       to,
+		CriteriaAdded:   []models.Criteria{},
+		CriteriaRemoved: []models.Criteria{},
+		BenefitsAdded:   []models.Benefit{},
+		BenefitsRemoved: []models.Benefit{},
+	}
+	if fromVersion.Name != toVersion.Name {
+		diff.Name = &models.ValueChange{From: fromVersion.Name, To: toVersion.Name}
+	}
+
+	// Each version has its own criteria rows, so criteria are compared by their conditions rather than their IDs
+	fromCriteria := make(map[string]bool)
+	for _, criteria := range fromVersion.Criteria {
+		fromCriteria[criteriaKey(criteria)] = true
+	}
+	toCriteria := make(map[string]bool)
+	for _, criteria := range toVersion.Criteria {
+		toCriteria[criteriaKey(criteria)] = true
+		if !fromCriteria[criteriaKey(criteria)] {
+			diff.CriteriaAdded = append(diff.CriteriaAdded, criteria)
+		}
+	}
+	for _, criteria := range fromVersion.Criteria {
+		if !toCriteria[criteriaKey(criteria)] {
+			diff.CriteriaRemoved = append(diff.CriteriaRemoved, criteria)
+		}
+	}
+
+	// Benefits are shared between versions, so they are compared by ID
+	fromBenefits := make(map[string]bool)
+	for _, benefit := range fromVersion.Benefits {
+		fromBenefits[benefit.ID] = true
+	}
+	toBenefits := make(map[string]bool)
+	for _, benefit := range toVersion.Benefits {
+		toBenefits[benefit.ID] = true
+		if !fromBenefits[benefit.ID] {
+			diff.BenefitsAdded = append(diff.BenefitsAdded, benefit)
+		}
+	}
+	for _, benefit := range fromVersion.Benefits {
+		if !toBenefits[benefit.ID] {
+			diff.BenefitsRemoved = append(diff.BenefitsRemoved, benefit)
+		}
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, diff)
+}
+
+// Check a scheme from a request, and default its effective_from to today
+func validateSchemeInput(input *models.SchemeInput) error {
+	if input.Name == "" {
+		return errors.New("scheme name is required")
+	}
+
+	if input.EffectiveFrom == "" {
+		input.EffectiveFrom = time.Now().Format(utils.DateLayout)
+	}
+	if _, err := time.Parse(utils.DateLayout, input.EffectiveFrom); err != nil {
+		return errors.New("effective_from must be in YYYY-MM-DD format")
+	}
+
+	// Criteria must use the same education levels as applicants, or they can never match
+	for _, level := range input.Criteria.EducationLevels {
+		if !utils.IsValidEducationLevel(level) {
+			return fmt.Errorf("Unknown education level %q, see /api/reference/education-levels", level)
+		}
+	}
+	return validateSchemeBenefits(input.Benefits)
+}
+
+// Insert a version of a scheme along with its own criteria row, and link its benefits
+// - Benefits are shared through the catalogue, so versions and schemes can offer the same one
+func insertSchemeVersion(tx *sql.Tx, schemeID string, version int, input models.SchemeInput) (string, error) {
+	versionID := uuid.New().String()
+	_, err := tx.Exec(
+		`INSERT INTO scheme_versions (id, scheme_id, version, name, effective_from) VALUES ($1, $2, $3, $4, $5)`,
+		versionID, schemeID, version, input.Name, input.EffectiveFrom,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	// Insert criteria into the `criteria` table
+	criteriaID := uuid.New().String()
+	_, err = tx.Exec(
+		`INSERT INTO criteria (id, employment_status, marital_status, education_levels, max_household_income_per_capita, max_savings)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		criteriaID, utils.NilIfEmpty(input.Criteria.EmploymentStatus), utils.NilIfEmpty(input.Criteria.MaritalStatus),
+		pq.Array(input.Criteria.EducationLevels), input.Criteria.MaxHouseholdIncomePerCapita, input.Criteria.MaxSavings,
+	)
+	if err != nil {
+		return "", fmt.Errorf("inserting criteria: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO scheme_version_criteria (version_id, criteria_id) VALUES ($1, $2)`, versionID, criteriaID)
+	if err != nil {
+		return "", fmt.Errorf("linking criteria: %v", err)
+	}
+
+	// Link the version to its catalogue benefits, adding any new ones to the catalogue
+	for _, benefit := range input.Benefits {
+		benefitID, err := catalogueBenefit(tx, benefit)
+		if err != nil {
+			return "", fmt.Errorf("inserting benefit: %w", err)
+		}
+
+		_, err = tx.Exec(`INSERT INTO scheme_version_benefits (version_id, benefit_id) VALUES ($1, $2)`, versionID, benefitID)
+		if err != nil {
+			return "", fmt.Errorf("linking benefit: %v", err)
+		}
+	}
+
+	return versionID, nil
+}
+
+// Point the scheme's name, scheme_criteria and scheme_benefits at a version
+// - These hold the version in effect today, for listing schemes
+func linkCurrentVersion(tx *sql.Tx, schemeID, versionID string) error {
+	_, err := tx.Exec(`
+		UPDATE schemes SET name = scheme_versions.name, current_version_id = scheme_versions.id
+		FROM scheme_versions
+		WHERE schemes.id = $1 AND scheme_versions.id = $2`, schemeID, versionID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM scheme_criteria WHERE scheme_id = $1`, schemeID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM scheme_benefits WHERE scheme_id = $1`, schemeID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO scheme_criteria (scheme_id, criteria_id)
+		SELECT $1, criteria_id FROM scheme_version_criteria WHERE version_id = $2`, schemeID, versionID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO scheme_benefits (scheme_id, benefit_id)
+		SELECT $1, benefit_id FROM scheme_version_benefits WHERE version_id = $2`, schemeID, versionID)
+	return err
+}
+
+// Start promoting scheme versions to current on the day they take effect, in the background
+func StartVersionPromotion() {
+	go func() {
+		ticker := time.NewTicker(versionPromotionInterval)
+		defer ticker.Stop()
+		for {
+			if err := promoteDueVersions(); err != nil {
+				log.Printf("Error promoting scheme versions: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Link every scheme whose current version is not the one in effect today to that version
+func promoteDueVersions() error {
+	rows, err := database.DB.Query(`
+		WITH current AS (
+			SELECT DISTINCT ON (scheme_versions.scheme_id) scheme_versions.scheme_id, scheme_versions.id
+			FROM scheme_versions
+			ORDER BY scheme_versions.scheme_id, ` + currentVersionOrder + `
+		)
+		SELECT current.scheme_id, current.id
+		FROM current JOIN schemes ON schemes.id = current.scheme_id
+		WHERE schemes.current_version_id IS DISTINCT FROM current.id`)
+	if err != nil {
+		return err
+	}
+	due := [][2]string{}
+	for rows.Next() {
+		var schemeID, versionID string
+		if err := rows.Scan(&schemeID, &versionID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, [2]string{schemeID, versionID})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, scheme := range due {
+		tx, err := database.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if err = linkCurrentVersion(tx, scheme[0], scheme[1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("linking scheme %s to version %s: %v", scheme[0], scheme[1], err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch the ID of the version of a scheme in effect on a date
+// - Returns sql.ErrNoRows if the scheme does not exist or had not started yet
+func fetchSchemeVersionOn(schemeID, date string) (string, error) {
+	var versionID string
+	err := database.DB.QueryRow(`
+		SELECT id FROM scheme_versions
+		WHERE scheme_id = $1 AND effective_from <= $2 AND (effective_to IS NULL OR effective_to > $2)`,
+		schemeID, date).Scan(&versionID)
+	return versionID, err
+}
+
+// Fetch every version of a scheme, oldest first, with their criteria and benefits
+func fetchSchemeVersions(schemeID string) ([]models.SchemeVersion, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, scheme_id, version, name, effective_from, effective_to, created_at
+		FROM scheme_versions
+		WHERE scheme_id = $1
+		ORDER BY version`, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []models.SchemeVersion{}
+	byID := make(map[string]int)
+	for rows.Next() {
+		var version models.SchemeVersion
+		var effectiveFrom time.Time
+		var effectiveTo sql.NullTime
+		err := rows.Scan(&version.ID, &version.SchemeID, &version.Version, &version.Name, &effectiveFrom, &effectiveTo, &version.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		version.EffectiveFrom = effectiveFrom.Format(utils.DateLayout)
+		if effectiveTo.Valid {
+			date := effectiveTo.Time.Format(utils.DateLayout)
+			version.EffectiveTo = &date
+		}
+		version.Criteria = []models.Criteria{}
+		version.Benefits = []models.Benefit{}
+		byID[version.ID] = len(versions)
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fetch the criteria of all the versions in one query
+	criteriaRows, err := database.DB.Query(`
+		SELECT scheme_version_criteria.version_id, `+criteriaColumns+`
+		FROM scheme_version_criteria
+		JOIN scheme_versions ON scheme_versions.id = scheme_version_criteria.version_id
+		JOIN criteria ON criteria.id = scheme_version_criteria.criteria_id
+		WHERE scheme_versions.scheme_id = $1`, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer criteriaRows.Close()
+
+	for criteriaRows.Next() {
+		var versionID string
+		criteria, err := scanCriteria(criteriaRows, &versionID)
+		if err != nil {
+			return nil, err
+		}
+		versions[byID[versionID]].Criteria = append(versions[byID[versionID]].Criteria, criteria)
+	}
+	if err = criteriaRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fetch the benefits of all the versions in one query
+	benefitRows, err := database.DB.Query(`
+		SELECT scheme_version_benefits.version_id, `+benefitColumns+`
+		FROM scheme_version_benefits
+		JOIN scheme_versions ON scheme_versions.id = scheme_version_benefits.version_id
+		JOIN benefits ON benefits.id = scheme_version_benefits.benefit_id
+		WHERE scheme_versions.scheme_id = $1`, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer benefitRows.Close()
+
+	for benefitRows.Next() {
+		var versionID string
+		benefit, err := scanBenefit(benefitRows, &versionID)
+		if err != nil {
+			return nil, err
+		}
+		versions[byID[versionID]].Benefits = append(versions[byID[versionID]].Benefits, benefit)
+	}
+	return versions, benefitRows.Err()
+}
+
+// The columns of a criteria row, in the order scanCriteria reads them
+const criteriaColumns = `criteria.id, COALESCE(criteria.marital_status, ''), COALESCE(criteria.employment_status, ''),
+	criteria.education_levels, criteria.max_household_income_per_capita, criteria.max_savings`
+
+// Scan a row of criteriaColumns, after any leading columns
+func scanCriteria(rows *sql.Rows, leading ...interface{}) (models.Criteria, error) {
+	var criteria models.Criteria
+	var educationLevels pq.StringArray
+	dest := append(leading, &criteria.ID, &criteria.MaritalStatus, &criteria.EmploymentStatus,
+		&educationLevels, &criteria.MaxHouseholdIncomePerCapita, &criteria.MaxSavings)
+	if err := rows.Scan(dest...); err != nil {
+		return criteria, err
+	}
+	criteria.EducationLevels = educationLevels
+	return criteria, nil
+}
+
+// Fetch the criteria and benefits of one version, as seen by a transaction
+func fetchVersionContents(tx *sql.Tx, versionID string) ([]models.Criteria, []models.Benefit, error) {
+	rows, err := tx.Query(`
+		SELECT `+criteriaColumns+`
+		FROM scheme_version_criteria
+		JOIN criteria ON criteria.id = scheme_version_criteria.criteria_id
+		WHERE scheme_version_criteria.version_id = $1
+		ORDER BY criteria.id`, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	criteriaList := []models.Criteria{}
+	for rows.Next() {
+		criteria, err := scanCriteria(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		criteriaList = append(criteriaList, criteria)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	benefitRows, err := tx.Query(`
+		SELECT `+benefitColumns+`
+		FROM scheme_version_benefits
+		JOIN benefits ON benefits.id = scheme_version_benefits.benefit_id
+		WHERE scheme_version_benefits.version_id = $1`, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer benefitRows.Close()
+
+	benefits := []models.Benefit{}
+	for benefitRows.Next() {
+		benefit, err := scanBenefit(benefitRows)
+		if err != nil {
+			return nil, nil, err
+		}
+		benefits = append(benefits, benefit)
+	}
+	return criteriaList, benefits, benefitRows.Err()
+}
+
+// Describe a criteria row by its conditions, ignoring its ID
+func criteriaKey(criteria models.Criteria) string {
+	maxIncome, maxSavings := "", ""
+	if criteria.MaxHouseholdIncomePerCapita != nil {
+		maxIncome = criteria.MaxHouseholdIncomePerCapita.String()
+	}
+	if criteria.MaxSavings != nil {
+		maxSavings = criteria.MaxSavings.String()
+	}
+	return strings.Join([]string{
+		criteria.MaritalStatus,
+		criteria.EmploymentStatus,
+		strings.Join(criteria.EducationLevels, ","),
+		maxIncome,
+		maxSavings,
+	}, "|")
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+)
+
+// The columns of a scheme's window, in the order scanSchemeWindow reads them
+const schemeWindowColumns = `schemes.status, schemes.open_at, schemes.close_at, schemes.rolling`
+
+// Check a scheme's window, defaulting its status to open
+func validateSchemeWindow(window *models.SchemeWindow) error {
+	if window.Status == "" {
+		window.Status = "open"
+	}
+	if !utils.IsValidSchemeStatus(window.Status) {
+		return errors.New("status must be one of draft, open, closed or archived")
+	}
+
+	for _, date := range []*string{window.OpenAt, window.CloseAt} {
+		if date == nil {
+			continue
+		}
+		if _, err := time.Parse(utils.DateLayout, *date); err != nil {
+			return errors.New("open_at and close_at must be in YYYY-MM-DD format")
+		}
+	}
+	if window.OpenAt != nil && window.CloseAt != nil && *window.CloseAt < *window.OpenAt {
+		return errors.New("close_at cannot be before open_at")
+	}
+
+	// A rolling window needs both dates to know which part of each year it covers
+	if window.Rolling && (window.OpenAt == nil || window.CloseAt == nil) {
+		return errors.New("a rolling window needs both open_at and close_at")
+	}
+	if window.Rolling && parseDate(*window.CloseAt).After(parseDate(*window.OpenAt).AddDate(1, 0, -1)) {
+		return errors.New("a rolling window cannot be longer than a year")
+	}
+	return nil
+}
+
+// Whether a scheme accepts applications on a date
+// - The scheme must be open, and the date must fall within its window
+// - A rolling window covers the same days of every year from the year it opens
+func acceptsApplications(window models.SchemeWindow, on time.Time) bool {
+	if window.Status != "open" {
+		return false
+	}
+	date := on.Format(utils.DateLayout)
+	if window.OpenAt != nil && date < *window.OpenAt {
+		return false
+	}
+	if !window.Rolling {
+		return window.CloseAt == nil || date <= *window.CloseAt
+	}
+
+	// Compare only the month and day, allowing for windows that cross the new year
+	openDay, closeDay, day := (*window.OpenAt)[5:], (*window.CloseAt)[5:], date[5:]
+	if openDay <= closeDay {
+		return openDay <= day && day <= closeDay
+	}
+	return day >= openDay || day <= closeDay
+}
+
+// The first day on or after a date that a scheme accepts applications
+// - Returns nil if the scheme is not open, or its window has already closed for good
+func nextOpening(window models.SchemeWindow, on time.Time) *time.Time {
+	if window.Status != "open" {
+		return nil
+	}
+	today := parseDate(on.Format(utils.DateLayout))
+	if acceptsApplications(window, on) {
+		return &today
+	}
+	if window.OpenAt != nil && today.Before(parseDate(*window.OpenAt)) {
+		opening := parseDate(*window.OpenAt)
+		return &opening
+	}
+	if !window.Rolling {
+		return nil
+	}
+
+	// The window has closed for this year, so it next opens on the same day as open_at next year
+	openAt := parseDate(*window.OpenAt)
+	opening := time.Date(today.Year(), openAt.Month(), openAt.Day(), 0, 0, 0, 0, time.UTC)
+	if opening.Before(today) {
+		opening = opening.AddDate(1, 0, 0)
+	}
+	return &opening
+}
+
+// Fetch a scheme's window
+func fetchSchemeWindow(schemeID string) (models.SchemeWindow, error) {
+	rows, err := database.DB.Query(`SELECT `+schemeWindowColumns+` FROM schemes WHERE id = $1`, schemeID)
+	if err != nil {
+		return models.SchemeWindow{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return models.SchemeWindow{}, err
+		}
+		return models.SchemeWindow{}, sql.ErrNoRows
+	}
+	return scanSchemeWindow(rows)
+}
+
+// Scan a row of schemeWindowColumns, after any leading columns
+func scanSchemeWindow(rows *sql.Rows, leading ...interface{}) (models.SchemeWindow, error) {
+	var window models.SchemeWindow
+	var openAt, closeAt sql.NullTime
+	dest := append(leading, &window.Status, &openAt, &closeAt, &window.Rolling)
+	if err := rows.Scan(dest...); err != nil {
+		return window, err
+	}
+	window.OpenAt = formatNullDate(openAt)
+	window.CloseAt = formatNullDate(closeAt)
+	return window, nil
+}
+
+// Format a nullable DATE column as YYYY-MM-DD
+func formatNullDate(date sql.NullTime) *string {
+	if !date.Valid {
+		return nil
+	}
+	formatted := date.Time.Format(utils.DateLayout)
+	return &formatted
+}
+
+// Parse a date that has already been validated
+func parseDate(value string) time.Time {
+	date, _ := time.Parse(utils.DateLayout, value)
+	return date
+}
@@ -1,27 +1,52 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/lib/pq" // Import pq for handling arrays
 
 	"github.com/neozhixuan/gt_assessment/database"
 	"github.com/neozhixuan/gt_assessment/models"
 	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
 )
 
+// GET request for all schemes
+// - ?expand=criteria,benefits embeds the full criteria and benefits instead of only their IDs
 func GetSchemes(w http.ResponseWriter, r *http.Request) {
 	var schemes []models.Scheme
 
+	var expandCriteria, expandBenefits bool
+	if expand := r.URL.Query().Get("expand"); expand != "" {
+		for _, field := range strings.Split(expand, ",") {
+			switch strings.TrimSpace(field) {
+			case "criteria":
+				expandCriteria = true
+			case "benefits":
+				expandBenefits = true
+			default:
+				http.Error(w, fmt.Sprintf("Unknown expand field %q, expected criteria or benefits", field), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	// Query to fetch all schemes with criteria_ids and benefit_ids
 	query := `
         SELECT schemes.id, schemes.name, 
         ARRAY(SELECT criteria_id FROM scheme_criteria WHERE scheme_id = schemes.id) AS criteria_ids, 
-        ARRAY(SELECT benefit_id FROM scheme_benefits WHERE scheme_id = schemes.id) AS benefit_ids
+        ARRAY(SELECT benefit_id FROM scheme_benefits WHERE scheme_id = schemes.id) AS benefit_ids,
+        ARRAY(SELECT document_type FROM scheme_required_documents WHERE scheme_id = schemes.id ORDER BY document_type) AS required_documents,
+        ` + applicationLimitColumns + `, ` + schemeWindowColumns + `
         FROM schemes
     `
 	rows, err := database.DB.Query(query)
@@ -33,18 +58,21 @@ func GetSchemes(w http.ResponseWriter, r *http.Request) {
 
 	for rows.Next() {
 		var scheme models.Scheme
-		var criteriaIDs, benefitIDs pq.StringArray // arrays for criteria and benefit IDs
+		var criteriaIDs, benefitIDs, requiredDocuments pq.StringArray // arrays for criteria and benefit IDs
 
 		// Scan the scheme row, retrieving criteria_ids and benefit_ids as arrays
-		err := rows.Scan(&scheme.ID, &scheme.Name, &criteriaIDs, &benefitIDs)
+		window, err := scanSchemeWindow(rows, &scheme.ID, &scheme.Name, &criteriaIDs, &benefitIDs, &requiredDocuments,
+			&scheme.MaxGrants, &scheme.RejectionCooldownDays, &scheme.GrantCooldownDays, &scheme.SLADays)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
 			return
 		}
+		scheme.SchemeWindow = window
 
 		// Store criteria and benefits IDs as strings in the Scheme model
 		scheme.CriteriaIDs = criteriaIDs
 		scheme.BenefitIDs = benefitIDs
+		scheme.RequiredDocuments = requiredDocuments
 
 		// Append the scheme to the result list
 		schemes = append(schemes, scheme)
@@ -56,9 +84,52 @@ func GetSchemes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Embed the full criteria and benefits if asked to, with one query each
+	if expandCriteria {
+		criteriaBySchemeID, err := fetchCriteriaBySchemeID()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching criteria: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for i := range schemes {
+			schemes[i].Criteria = criteriaBySchemeID[schemes[i].ID]
+		}
+	}
+	if expandBenefits {
+		benefitsBySchemeID, err := fetchBenefitsBySchemeID()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching benefits: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for i := range schemes {
+			schemes[i].Benefits = benefitsBySchemeID[schemes[i].ID]
+		}
+	}
+
 	utils.SendJSONResponse(w, http.StatusOK, schemes)
 }
 
+// GET request for a single scheme with its criteria and benefits
+func GetScheme(w http.ResponseWriter, r *http.Request) {
+	schemeID := mux.Vars(r)["id"]
+
+	scheme, err := fetchScheme(schemeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, scheme)
+}
+
+// GET request for the schemes an applicant is eligible for
+// - An optional ?as_of=YYYY-MM-DD evaluates eligibility as it was on that date, e.g. for appeals and audits
+// - Schemes whose window is closed on that date are left out, unless ?include_closed=true
+// - An optional ?beneficiaries= limits eligibility to those members of the household, as for an application made for them
 func GetEligibleSchemes(w http.ResponseWriter, r *http.Request) {
 	// Get the ID from params
 	applicantID := r.URL.Query().Get("applicant")
@@ -66,145 +137,260 @@ func GetEligibleSchemes(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "applicant ID is required", http.StatusBadRequest)
 		return
 	}
-
-	// Populate the data from the applicant that we need
-	var applicant models.ApplicantResponse
-	query := `
-		SELECT id, employment_status, 
-		CASE 
-			WHEN id IN (SELECT id1 FROM relations WHERE relation = 'spouse') THEN 'married' 
-			ELSE 'single'
-		END AS marital_status
-		FROM applicants 
-		WHERE id = $1`
-	err := database.DB.QueryRow(query, applicantID).Scan(&applicant.ID, &applicant.EmploymentStatus, &applicant.MaritalStatus)
+	asOf, err := parseAsOf(r.URL.Query().Get("as_of"))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching applicant: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Fetch children related to the applicant and calculate education levels
-	childrenQuery := `
-		SELECT id2, date_of_birth 
-		FROM relations 
-		JOIN applicants ON relations.id2 = applicants.id
-		WHERE relations.id1 = $1 AND relations.relation = 'child'`
-	rows, err := database.DB.Query(childrenQuery, applicantID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching children: %v", err), http.StatusInternalServerError)
-		return
+	// Optionally only for some members of the household, e.g. ?beneficiaries=id1,id2
+	var beneficiaries []string
+	if value := r.URL.Query().Get("beneficiaries"); value != "" {
+		beneficiaries = strings.Split(value, ",")
 	}
-	defer rows.Close()
-
-	// Create a set to track all the unique education levels of the applicant's children
-	childrenEducationLevels := make(map[string]bool)
-	for rows.Next() {
-		var childID string
-		var dob string
-		if err := rows.Scan(&childID, &dob); err != nil {
-			http.Error(w, fmt.Sprintf("Error scanning child: %v", err), http.StatusInternalServerError)
-			return
-		}
 
-		// Calculate the child's age
-		childAge := utils.CalculateAge(dob)
-		level := utils.CalculateEducationLevel(childAge)
-		childrenEducationLevels[level] = true
-	}
-
-	// Convert map to a slice of unique education levels
-	for level := range childrenEducationLevels {
-		applicant.ChildrenLevel = append(applicant.ChildrenLevel, level)
-	}
-
-	// Fetch eligible schemes based on the applicant's marital status, employment status, and children education levels
-	schemes := []models.Scheme{}
-
-	// We check that the scheme has criterias
-	// Then, we left join each criteria to a criteria in the criteria table
-	// Then, we check that our conditions are fulfilled
-	// In the last row, we check that the count of actual criteria matched with the total number of criteria specified for the scheme
-	schemeQuery := `
-    SELECT schemes.id, schemes.name
-    FROM schemes
-    LEFT JOIN scheme_criteria ON schemes.id = scheme_criteria.scheme_id
-    LEFT JOIN criteria ON criteria.id = scheme_criteria.criteria_id
-    WHERE (criteria.marital_status IS NULL OR criteria.marital_status = $1)
-      AND (criteria.employment_status IS NULL OR criteria.employment_status = $2)
-      AND (criteria.education_levels IS NULL OR criteria.education_levels && $3::text[])
-    GROUP BY schemes.id, schemes.name
-    HAVING COUNT(criteria.id) = (
-        SELECT COUNT(*) FROM scheme_criteria WHERE scheme_criteria.scheme_id = schemes.id
-    );`
-
-	// Make the applicant's children education array into a Postgres Array
-	// Use it in our SQL query
-	educationLevelArray := pq.Array(applicant.ChildrenLevel)
-	rows, err = database.DB.Query(schemeQuery, applicant.MaritalStatus, applicant.EmploymentStatus, educationLevelArray)
+	schemes, err := fetchEligibleSchemes(applicantID, asOf, beneficiaries)
+	if err == errApplicantNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotInHousehold) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching eligible scheme: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error fetching eligible schemes: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	// Update our final array for return
-	for rows.Next() {
-		var scheme models.Scheme
-		if err := rows.Scan(&scheme.ID, &scheme.Name); err != nil {
-			http.Error(w, fmt.Sprintf("Error scanning scheme: %v", err), http.StatusInternalServerError)
-			return
+	// Leave out schemes that are not accepting applications, unless asked for with ?include_closed=true
+	if r.URL.Query().Get("include_closed") != "true" {
+		open := []models.Scheme{}
+		for _, scheme := range schemes {
+			if *scheme.AcceptingApplications {
+				open = append(open, scheme)
+			}
 		}
-		schemes = append(schemes, scheme)
-	}
-	if err = rows.Err(); err != nil {
-		http.Error(w, fmt.Sprintf("Error iterating scheme: %v", err), http.StatusInternalServerError)
-		return
+		schemes = open
 	}
 
 	// Send eligible schemes as response
 	utils.SendJSONResponse(w, http.StatusOK, schemes)
 }
 
+// PUT request to change a scheme's name, criteria, benefits, application window and limits
+// - Takes the same shape as CreateScheme, and applies only what differs from the version in effect today
+// - Criteria and benefits of a version that applications are pinned to cannot be changed, publish a new version instead
 func UpdateScheme(w http.ResponseWriter, r *http.Request) {
-	// Extract scheme ID from URL
-	schemeID := r.URL.Query().Get("scheme")
+	// The scheme ID is in the path, or in ?scheme= for older clients
+	schemeID := mux.Vars(r)["id"]
+	if schemeID == "" {
+		schemeID = r.URL.Query().Get("scheme")
+	}
 	if schemeID == "" {
 		http.Error(w, "scheme ID is required", http.StatusBadRequest)
 		return
 	}
 	// Parse request body
-	var scheme models.Scheme
-	if err := json.NewDecoder(r.Body).Decode(&scheme); err != nil {
+	var update models.SchemeUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
 		http.Error(w, fmt.Sprintf("Error input payload: %v", err), http.StatusBadRequest)
 		return
 	}
+	if update.Criteria != nil {
+		for _, level := range update.Criteria.EducationLevels {
+			if !utils.IsValidEducationLevel(level) {
+				http.Error(w, fmt.Sprintf("Unknown education level %q, see /api/reference/education-levels", level), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if update.Benefits != nil {
+		if err := validateSchemeBenefits(*update.Benefits); err != nil {
+			http.Error(w, err.Error(), schemeBenefitsStatus(err))
+			return
+		}
+	}
+
+	// Start a transaction so that the scheme is never left half updated
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting tx: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the version of the scheme in effect today
+	// - A version due to start later is left alone, so it is published as it was
+	var versionID string
+	err = tx.QueryRow(`SELECT id FROM scheme_versions WHERE scheme_id = $1 ORDER BY `+currentVersionOrder+` LIMIT 1 FOR UPDATE`, schemeID).
+		Scan(&versionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "scheme not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Work out what differs from the stored criteria and benefits
+	changes, err := diffSchemeUpdate(tx, versionID, update)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error comparing scheme: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if changes.any() {
+		// Applications pinned to this version must keep being assessed against what they applied under
+		var pinned bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM applications WHERE scheme_version_id = $1)`, versionID).Scan(&pinned)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking applications: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if pinned {
+			http.Error(w, "applications have been made under the current version, publish a new version through /api/schemes/versions instead",
+				http.StatusConflict)
+			return
+		}
+
+		err = changes.apply(tx, versionID)
+		if errors.Is(err, errBenefitRetired) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating scheme: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err = linkCurrentVersion(tx, schemeID, versionID); err != nil {
+			http.Error(w, fmt.Sprintf("Error linking scheme to version: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Change when the scheme accepts applications, if any part of its window was given
+	opened := false
+	if update.Status != "" || update.OpenAt != nil || update.CloseAt != nil || update.Rolling != nil {
+		window, err := fetchSchemeWindow(schemeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching scheme window: %v", err), http.StatusInternalServerError)
+			return
+		}
+		wasAccepting := acceptsApplications(window, time.Now())
+		if update.Status != "" {
+			window.Status = update.Status
+		}
+		if update.OpenAt != nil {
+			window.OpenAt = update.OpenAt
+			if *update.OpenAt == "" {
+				window.OpenAt = nil
+			}
+		}
+		if update.CloseAt != nil {
+			window.CloseAt = update.CloseAt
+			if *update.CloseAt == "" {
+				window.CloseAt = nil
+			}
+		}
+		if update.Rolling != nil {
+			window.Rolling = *update.Rolling
+		}
+		if err := validateSchemeWindow(&window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE schemes SET status = $1, open_at = $2, close_at = $3, rolling = $4 WHERE id = $5`,
+			window.Status, window.OpenAt, window.CloseAt, window.Rolling, schemeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating scheme window: %v", err), http.StatusInternalServerError)
+			return
+		}
+		opened = !wasAccepting && nextOpening(window, time.Now()) != nil
+	}
 
-	// Build update query dynamically based on non-empty fields
-	query := "UPDATE schemes SET "
-	values := []interface{}{}
-	counter := 1
+	// New criteria may let in applicants who did not qualify before, and opening the scheme lets in everyone who does
+	reason := ""
+	if changes.criteriaChanged() {
+		reason = "criteria_changed"
+	} else if opened {
+		reason = "opened"
+	}
+	if reason != "" {
+		if _, err = queueOutreach(tx, schemeID, reason); err != nil {
+			http.Error(w, fmt.Sprintf("Error queueing outreach: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if scheme.Name != "" {
-		query += "name = $" + fmt.Sprint(counter) + ", "
-		values = append(values, scheme.Name)
-		counter++
+	// Change how often applicants can apply for and be granted the scheme, if any limit was given
+	if update.MaxGrants != nil || update.RejectionCooldownDays != nil || update.GrantCooldownDays != nil || update.SLADays != nil {
+		limits, err := fetchApplicationLimits(schemeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching application limits: %v", err), http.StatusInternalServerError)
+			return
+		}
+		mergeApplicationLimits(&limits, update.ApplicationLimits)
+		if err := validateApplicationLimits(limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE schemes SET max_grants = $1, rejection_cooldown_days = $2, grant_cooldown_days = $3, sla_days = $4
+			WHERE id = $5`,
+			limits.MaxGrants, limits.RejectionCooldownDays, limits.GrantCooldownDays, limits.SLADays, schemeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating application limits: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Replace the documents applicants must provide, if given
+	if update.RequiredDocuments != nil {
+		if err := validateDocumentTypes(*update.RequiredDocuments); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = saveRequiredDocuments(tx, schemeID, *update.RequiredDocuments); err != nil {
+			http.Error(w, fmt.Sprintf("Error updating required documents: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A rename corrects the current version in place, rather than publishing a new one
+	if update.Name != "" {
+		_, err = tx.Exec(`UPDATE schemes SET name = $1 WHERE id = $2`, update.Name, schemeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating scheme: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec(`UPDATE scheme_versions SET name = $1 WHERE id = $2`, update.Name, versionID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating scheme version: %v", err), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// Remove trailing comma and space
-	query = query[:len(query)-2]
+	if err = webhooks.Enqueue(tx, webhooks.SchemeUpdated, models.SchemeUpdated{SchemeID: schemeID, VersionID: versionID}); err != nil {
+		http.Error(w, fmt.Sprintf("Error recording event: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	// Add WHERE clause
-	query += " WHERE id = $" + fmt.Sprint(counter)
-	values = append(values, schemeID)
+	// Commit the transaction to save all the changes
+	if err = tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing tx: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	// Execute the query
-	_, err := database.DB.Exec(query, values...)
+	scheme, err := fetchScheme(schemeID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error updating scheme: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error fetching scheme: %v", err), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Scheme updated successfully"))
+	utils.SendJSONResponse(w, http.StatusOK, scheme)
 }
 
 func DeleteScheme(w http.ResponseWriter, r *http.Request) {
@@ -263,6 +449,26 @@ func CreateScheme(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check each scheme, defaulting the first version to start today
+	for i := range requestBody.Schemes {
+		if err := validateSchemeInput(&requestBody.Schemes[i]); err != nil {
+			http.Error(w, err.Error(), schemeBenefitsStatus(err))
+			return
+		}
+		if err := validateSchemeWindow(&requestBody.Schemes[i].SchemeWindow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateApplicationLimits(requestBody.Schemes[i].ApplicationLimits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateDocumentTypes(requestBody.Schemes[i].RequiredDocuments); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Start a transaction
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -273,60 +479,49 @@ func CreateScheme(w http.ResponseWriter, r *http.Request) {
 
 	for _, scheme := range requestBody.Schemes {
 		log.Println(scheme)
-		// 1. Insert criteria into the `criteria` table
-		criteriaID := uuid.New().String() // Use a function to generate a new UUID
+		// 1. Insert the scheme into the `schemes` table
 		_, err = tx.Exec(
-			`INSERT INTO criteria (id, employment_status, marital_status, education_levels) VALUES ($1, $2, $3, $4)`,
-			criteriaID, utils.NilIfEmpty(scheme.Criteria.EmploymentStatus), utils.NilIfEmpty(scheme.Criteria.MaritalStatus), pq.Array(scheme.Criteria.EducationLevels),
+			`INSERT INTO schemes (id, name, status, open_at, close_at, rolling, max_grants, rejection_cooldown_days, grant_cooldown_days, sla_days)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			scheme.ID, scheme.Name, scheme.Status, scheme.OpenAt, scheme.CloseAt, scheme.Rolling,
+			scheme.MaxGrants, scheme.RejectionCooldownDays, scheme.GrantCooldownDays, scheme.SLADays,
 		)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "Failed to insert criteria", http.StatusInternalServerError)
+			http.Error(w, "Failed to insert scheme", http.StatusInternalServerError)
 			return
 		}
 
-		// 2. Insert the scheme into the `schemes` table
-		_, err = tx.Exec(
-			`INSERT INTO schemes (id, name) VALUES ($1, $2)`,
-			scheme.ID, scheme.Name,
-		)
+		// 2. Insert the criteria and benefits as the scheme's first version
+		versionID, err := insertSchemeVersion(tx, scheme.ID, 1, scheme)
+		if errors.Is(err, errBenefitRetired) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "Failed to insert scheme", http.StatusInternalServerError)
+			http.Error(w, "Failed to insert scheme version", http.StatusInternalServerError)
 			return
 		}
 
-		// 3. Insert the relationship into `scheme_criteria`
-		_, err = tx.Exec(
-			`INSERT INTO scheme_criteria (scheme_id, criteria_id) VALUES ($1, $2)`,
-			scheme.ID, criteriaID,
-		)
-		if err != nil {
-			http.Error(w, "Failed to insert scheme_criteria relationship", http.StatusInternalServerError)
+		// 3. Link the version's criteria and benefits to the scheme
+		if err = linkCurrentVersion(tx, scheme.ID, versionID); err != nil {
+			log.Println(err)
+			http.Error(w, "Failed to link scheme criteria and benefits", http.StatusInternalServerError)
 			return
 		}
 
-		// 4. Insert the benefits into the `benefits` table and link them to the scheme
-		for _, benefit := range scheme.Benefits {
-			// Insert the benefit
-			_, err = tx.Exec(
-				`INSERT INTO benefits (id, name, amount) VALUES ($1, $2, $3)`,
-				benefit.ID, benefit.Name, benefit.Amount,
-			)
-			if err != nil {
-				http.Error(w, "Failed to insert benefit", http.StatusInternalServerError)
-				return
-			}
+		// 4. Record the documents applicants must provide
+		if err = saveRequiredDocuments(tx, scheme.ID, scheme.RequiredDocuments); err != nil {
+			log.Println(err)
+			http.Error(w, "Failed to insert required documents", http.StatusInternalServerError)
+			return
+		}
 
-			// Link the benefit to the scheme
-			_, err = tx.Exec(
-				`INSERT INTO scheme_benefits (scheme_id, benefit_id) VALUES ($1, $2)`,
-				scheme.ID, benefit.ID,
-			)
-			if err != nil {
-				http.Error(w, "Failed to insert scheme_benefit relationship", http.StatusInternalServerError)
-				return
-			}
+		// 5. Look for existing applicants who already qualify
+		if _, err = queueOutreach(tx, scheme.ID, "created"); err != nil {
+			http.Error(w, fmt.Sprintf("Error queueing outreach: %v", err), http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -340,3 +535,240 @@ func CreateScheme(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Scheme(s) created successfully"))
 }
+
+// Fetch a scheme with the criteria and benefits of the version in effect today
+func fetchScheme(schemeID string) (models.Scheme, error) {
+	scheme := models.Scheme{ID: schemeID}
+	versions, err := fetchSchemeVersions(schemeID)
+	if err != nil {
+		return scheme, err
+	}
+	if len(versions) == 0 {
+		return scheme, sql.ErrNoRows
+	}
+
+	scheme.SchemeWindow, err = fetchSchemeWindow(schemeID)
+	if err != nil {
+		return scheme, err
+	}
+	scheme.ApplicationLimits, err = fetchApplicationLimits(schemeID)
+	if err != nil {
+		return scheme, err
+	}
+	scheme.RequiredDocuments, err = fetchRequiredDocuments(database.DB, schemeID)
+	if err != nil {
+		return scheme, err
+	}
+
+	// Versions are oldest first, so the current one is the last to have started, or the first if none has
+	current := versions[0]
+	today := time.Now().Format(utils.DateLayout)
+	for _, version := range versions {
+		if version.EffectiveFrom <= today {
+			current = version
+		}
+	}
+	scheme.Name = current.Name
+	scheme.VersionID = current.ID
+	scheme.Version = current.Version
+	scheme.Criteria = current.Criteria
+	scheme.Benefits = current.Benefits
+	scheme.CriteriaIDs = []string{}
+	for _, criteria := range current.Criteria {
+		scheme.CriteriaIDs = append(scheme.CriteriaIDs, criteria.ID)
+	}
+	scheme.BenefitIDs = []string{}
+	for _, benefit := range current.Benefits {
+		scheme.BenefitIDs = append(scheme.BenefitIDs, benefit.ID)
+	}
+	return scheme, nil
+}
+
+// The changes needed to bring a scheme version's criteria and benefits in line with an update
+type schemeChanges struct {
+	criteriaInserted *models.Criteria
+	criteriaUpdated  *models.Criteria
+	criteriaUnlinked []string
+	benefitsLinked   []models.Benefit
+	benefitsUnlinked []string
+}
+
+// Compare an update against a version's stored criteria and benefits
+// - The update's criteria replace the stored criteria with the same ID, or the first one if it has no ID
+// - Benefits are matched by ID, and are changed through the benefit catalogue rather than here
+func diffSchemeUpdate(tx *sql.Tx, versionID string, update models.SchemeUpdate) (schemeChanges, error) {
+	var changes schemeChanges
+	storedCriteria, storedBenefits, err := fetchVersionContents(tx, versionID)
+	if err != nil {
+		return changes, err
+	}
+
+	if update.Criteria != nil {
+		desired := *update.Criteria
+		kept := -1
+		for i, criteria := range storedCriteria {
+			if criteria.ID == desired.ID {
+				kept = i
+			}
+		}
+		if kept == -1 && desired.ID == "" && len(storedCriteria) > 0 {
+			kept = 0
+		}
+
+		if kept == -1 {
+			desired.ID = uuid.New().String()
+			changes.criteriaInserted = &desired
+		} else if criteriaKey(storedCriteria[kept]) != criteriaKey(desired) {
+			desired.ID = storedCriteria[kept].ID
+			changes.criteriaUpdated = &desired
+		}
+		for i, criteria := range storedCriteria {
+			if i != kept {
+				changes.criteriaUnlinked = append(changes.criteriaUnlinked, criteria.ID)
+			}
+		}
+	}
+
+	if update.Benefits != nil {
+		stored := make(map[string]bool)
+		for _, benefit := range storedBenefits {
+			stored[benefit.ID] = true
+		}
+		desired := make(map[string]bool)
+		for _, benefit := range *update.Benefits {
+			desired[benefit.ID] = true
+			if !stored[benefit.ID] {
+				changes.benefitsLinked = append(changes.benefitsLinked, benefit)
+			}
+		}
+		for _, benefit := range storedBenefits {
+			if !desired[benefit.ID] {
+				changes.benefitsUnlinked = append(changes.benefitsUnlinked, benefit.ID)
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// Whether the update changes anything besides the name
+func (changes schemeChanges) any() bool {
+	return changes.criteriaInserted != nil || changes.criteriaUpdated != nil || len(changes.criteriaUnlinked) > 0 ||
+		len(changes.benefitsLinked) > 0 || len(changes.benefitsUnlinked) > 0
+}
+
+// Whether the changes could change who is eligible for the scheme
+func (changes schemeChanges) criteriaChanged() bool {
+	return changes.criteriaInserted != nil || changes.criteriaUpdated != nil || len(changes.criteriaUnlinked) > 0
+}
+
+// Apply the changes to a scheme version
+// - Criteria rows belong to a single version, so unlinked ones are deleted
+// - Benefits may be shared, so unlinked ones are kept
+func (changes schemeChanges) apply(tx *sql.Tx, versionID string) error {
+	if criteria := changes.criteriaInserted; criteria != nil {
+		_, err := tx.Exec(
+			`INSERT INTO criteria (id, employment_status, marital_status, education_levels, max_household_income_per_capita, max_savings)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			criteria.ID, utils.NilIfEmpty(criteria.EmploymentStatus), utils.NilIfEmpty(criteria.MaritalStatus),
+			pq.Array(criteria.EducationLevels), criteria.MaxHouseholdIncomePerCapita, criteria.MaxSavings,
+		)
+		if err != nil {
+			return fmt.Errorf("inserting criteria: %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO scheme_version_criteria (version_id, criteria_id) VALUES ($1, $2)`, versionID, criteria.ID)
+		if err != nil {
+			return fmt.Errorf("linking criteria: %v", err)
+		}
+	}
+
+	if criteria := changes.criteriaUpdated; criteria != nil {
+		_, err := tx.Exec(
+			`UPDATE criteria SET employment_status = $1, marital_status = $2, education_levels = $3,
+				max_household_income_per_capita = $4, max_savings = $5
+			WHERE id = $6`,
+			utils.NilIfEmpty(criteria.EmploymentStatus), utils.NilIfEmpty(criteria.MaritalStatus), pq.Array(criteria.EducationLevels),
+			criteria.MaxHouseholdIncomePerCapita, criteria.MaxSavings, criteria.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("updating criteria: %v", err)
+		}
+	}
+
+	for _, criteriaID := range changes.criteriaUnlinked {
+		_, err := tx.Exec(`DELETE FROM scheme_criteria WHERE criteria_id = $1`, criteriaID)
+		if err != nil {
+			return fmt.Errorf("unlinking criteria: %v", err)
+		}
+		_, err = tx.Exec(`DELETE FROM criteria WHERE id = $1`, criteriaID)
+		if err != nil {
+			return fmt.Errorf("deleting criteria: %v", err)
+		}
+	}
+
+	for _, benefit := range changes.benefitsLinked {
+		benefitID, err := catalogueBenefit(tx, benefit)
+		if err != nil {
+			return fmt.Errorf("inserting benefit: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO scheme_version_benefits (version_id, benefit_id) VALUES ($1, $2)`, versionID, benefitID)
+		if err != nil {
+			return fmt.Errorf("linking benefit: %v", err)
+		}
+	}
+
+	for _, benefitID := range changes.benefitsUnlinked {
+		_, err := tx.Exec(`DELETE FROM scheme_version_benefits WHERE version_id = $1 AND benefit_id = $2`, versionID, benefitID)
+		if err != nil {
+			return fmt.Errorf("unlinking benefit: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Fetch the criteria linked to every scheme, by scheme ID
+func fetchCriteriaBySchemeID() (map[string][]models.Criteria, error) {
+	rows, err := database.DB.Query(`
+		SELECT scheme_criteria.scheme_id, ` + criteriaColumns + `
+		FROM scheme_criteria
+		JOIN criteria ON criteria.id = scheme_criteria.criteria_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	criteriaBySchemeID := make(map[string][]models.Criteria)
+	for rows.Next() {
+		var schemeID string
+		criteria, err := scanCriteria(rows, &schemeID)
+		if err != nil {
+			return nil, err
+		}
+		criteriaBySchemeID[schemeID] = append(criteriaBySchemeID[schemeID], criteria)
+	}
+	return criteriaBySchemeID, rows.Err()
+}
+
+// Fetch the benefits linked to every scheme, by scheme ID
+func fetchBenefitsBySchemeID() (map[string][]models.Benefit, error) {
+	rows, err := database.DB.Query(`
+		SELECT scheme_benefits.scheme_id, ` + benefitColumns + `
+		FROM scheme_benefits
+		JOIN benefits ON benefits.id = scheme_benefits.benefit_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	benefitsBySchemeID := make(map[string][]models.Benefit)
+	for rows.Next() {
+		var schemeID string
+		benefit, err := scanBenefit(rows, &schemeID)
+		if err != nil {
+			return nil, err
+		}
+		benefitsBySchemeID[schemeID] = append(benefitsBySchemeID[schemeID], benefit)
+	}
+	return benefitsBySchemeID, rows.Err()
+}
@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/models"
+	"github.com/neozhixuan/gt_assessment/utils"
+	"github.com/neozhixuan/gt_assessment/webhooks"
+)
+
+// GET request for the webhook subscriptions
+func GetWebhookSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := fetchWebhookSubscriptions(`WHERE TRUE`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching webhook subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, subscriptions)
+}
+
+// POST request to subscribe a URL to events
+// - The response carries the secret payloads are signed with, which is not shown again
+func CreateWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	var subscription models.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookSubscription(subscription.URL, subscription.EventTypes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, fmt.Sprintf("Error generating secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+	subscription.Secret = "whsec_" + hex.EncodeToString(secret)
+	encryptedSecret, err := encryption.Encrypt(subscription.Secret)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	subscription.ID = uuid.New().String()
+	subscription.Active = true
+	err = database.DB.QueryRow(`
+		INSERT INTO webhook_subscriptions (id, url, event_types, secret) VALUES ($1, $2, $3, $4)
+		RETURNING created_at`, subscription.ID, subscription.URL, pq.Array(subscription.EventTypes), encryptedSecret).
+		Scan(&subscription.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating webhook subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusCreated, subscription)
+}
+
+// PUT request to change a subscription's URL or events, or to pause it
+// - A paused subscription is not sent events that happen while it is paused
+func UpdateWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	subscriptionID := mux.Vars(r)["id"]
+
+	var update models.WebhookSubscriptionUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	subscriptions, err := fetchWebhookSubscriptions(`WHERE id::text = $1`, subscriptionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching webhook subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(subscriptions) == 0 {
+		http.Error(w, "webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	subscription := subscriptions[0]
+	if update.URL != nil {
+		subscription.URL = *update.URL
+	}
+	if update.EventTypes != nil {
+		subscription.EventTypes = *update.EventTypes
+	}
+	if update.Active != nil {
+		subscription.Active = *update.Active
+	}
+	if err := validateWebhookSubscription(subscription.URL, subscription.EventTypes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = database.DB.Exec(`UPDATE webhook_subscriptions SET url = $1, event_types = $2, active = $3 WHERE id = $4`,
+		subscription.URL, pq.Array(subscription.EventTypes), subscription.Active, subscription.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating webhook subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, subscription)
+}
+
+// DELETE request to remove a subscription, along with its deliveries
+func DeleteWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	result, err := database.DB.Exec(`DELETE FROM webhook_subscriptions WHERE id::text = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting webhook subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		http.Error(w, "webhook subscription not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Webhook subscription deleted successfully"))
+}
+
+// GET request for a subscription's deliveries with the log of their attempts, newest first, optionally filtered by ?status=
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	where := `WHERE webhook_deliveries.subscription_id::text = $1`
+	values := []interface{}{mux.Vars(r)["id"]}
+	if status := r.URL.Query().Get("status"); status != "" {
+		values = append(values, status)
+		where += ` AND webhook_deliveries.status = $2`
+	}
+
+	deliveries, err := fetchWebhookDeliveries(where, values...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching webhook deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSONResponse(w, http.StatusOK, deliveries)
+}
+
+// POST request to try a failed delivery again, with a fresh set of attempts
+func RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var status string
+	err := database.DB.QueryRow(`
+		SELECT status FROM webhook_deliveries WHERE id::text = $1 AND subscription_id::text = $2`,
+		vars["deliveryID"], vars["id"]).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "webhook delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching webhook delivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if status != "failed" {
+		http.Error(w, fmt.Sprintf("only failed deliveries can be retried, this one is %s", status), http.StatusConflict)
+		return
+	}
+
+	_, err = database.DB.Exec(`
+		UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'failed'`, vars["deliveryID"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrying webhook delivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := fetchWebhookDeliveries(`WHERE webhook_deliveries.id = $1`, vars["deliveryID"])
+	if err != nil || len(deliveries) == 0 {
+		http.Error(w, fmt.Sprintf("Error fetching webhook delivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+	utils.SendJSONResponse(w, http.StatusOK, deliveries[0])
+}
+
+// Check a subscription's URL and events
+func validateWebhookSubscription(rawURL string, eventTypes []string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(eventTypes) == 0 {
+		return fmt.Errorf("event_types must list at least one of %s", strings.Join(webhooks.EventTypes, ", "))
+	}
+	for _, eventType := range eventTypes {
+		if !webhooks.IsEventType(eventType) {
+			return fmt.Errorf("Unknown event type %q, expected one of %s", eventType, strings.Join(webhooks.EventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// Fetch subscriptions matching a WHERE clause, oldest first, without their secrets
+func fetchWebhookSubscriptions(where string, args ...interface{}) ([]models.WebhookSubscription, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, url, event_types, active, created_at FROM webhook_subscriptions `+where+`
+		ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []models.WebhookSubscription{}
+	for rows.Next() {
+		var subscription models.WebhookSubscription
+		var eventTypes pq.StringArray
+		if err := rows.Scan(&subscription.ID, &subscription.URL, &eventTypes, &subscription.Active, &subscription.CreatedAt); err != nil {
+			return nil, err
+		}
+		subscription.EventTypes = eventTypes
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// Fetch deliveries matching a WHERE clause, newest first, each with the log of its attempts
+func fetchWebhookDeliveries(where string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	rows, err := database.DB.Query(`
+		SELECT webhook_deliveries.id, webhook_deliveries.subscription_id, webhook_deliveries.event_id, outbox_events.event_type,
+			webhook_deliveries.status, webhook_deliveries.attempts, webhook_deliveries.next_attempt_at,
+			webhook_deliveries.last_status_code, webhook_deliveries.last_error, webhook_deliveries.delivered_at,
+			webhook_deliveries.created_at
+		FROM webhook_deliveries JOIN outbox_events ON outbox_events.id = webhook_deliveries.event_id
+		`+where+`
+		ORDER BY webhook_deliveries.created_at DESC, webhook_deliveries.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	indexByID := make(map[string]int)
+	for rows.Next() {
+		delivery := models.WebhookDelivery{Log: []models.WebhookAttempt{}}
+		err := rows.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.EventID, &delivery.EventType, &delivery.Status,
+			&delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastStatusCode, &delivery.LastError, &delivery.DeliveredAt,
+			&delivery.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		indexByID[delivery.ID] = len(deliveries)
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return deliveries, nil
+	}
+
+	deliveryIDs := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		deliveryIDs[i] = delivery.ID
+	}
+	rows, err = database.DB.Query(`
+		SELECT delivery_id, attempt, status_code, error, duration_ms, attempted_at FROM webhook_delivery_attempts
+		WHERE delivery_id = ANY($1::uuid[])
+		ORDER BY attempted_at, attempt`, pq.Array(deliveryIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deliveryID string
+		var attempt models.WebhookAttempt
+		err := rows.Scan(&deliveryID, &attempt.Attempt, &attempt.StatusCode, &attempt.Error, &attempt.DurationMs, &attempt.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		i := indexByID[deliveryID]
+		deliveries[i].Log = append(deliveries[i].Log, attempt)
+	}
+	return deliveries, rows.Err()
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
+
+	"github.com/neozhixuan/gt_assessment/encryption"
 )
 
 // Initialise a global SQL DB object that can be accessed from anywhere
@@ -35,9 +38,21 @@ func InitDB() {
 	// Initialize tables
 	initTables()
 
+	// Bring tables created by older versions up to date
+	migrateTables()
+
 	// Seed the database with initial data
 	seedData()
 
+	// Fill in data that older versions and the seed data do not have
+	backfillData()
+
+	// Encrypt plaintext applicant fields, and re-wrap fields under a retired key
+	encryptApplicants()
+	rotateEncryptedColumns("applicant_contacts", "applicant_id", "email", "phone")
+	rotateEncryptedColumns("notifications", "id", "recipient", "subject", "body")
+	rotateEncryptedColumns("webhook_subscriptions", "id", "secret")
+
 	// Console log success
 	log.Println("Set up database successfully.")
 }
@@ -47,10 +62,15 @@ func initTables() {
 	applicantsTable := `
 	CREATE TABLE IF NOT EXISTS applicants (
 		id UUID PRIMARY KEY,
-		name VARCHAR(100) NOT NULL,
+		name TEXT NOT NULL, -- Encrypted
+		name_index TEXT, -- Blind index of the name for exact-match lookups
 		employment_status VARCHAR(50) NOT NULL,
 		sex VARCHAR(10) NOT NULL,
-		date_of_birth DATE NOT NULL
+		date_of_birth TEXT NOT NULL, -- Encrypted, YYYY-MM-DD
+		national_id TEXT, -- Encrypted NRIC/FIN
+		national_id_index TEXT UNIQUE, -- Blind index of the national ID
+		marital_status VARCHAR(50) NOT NULL DEFAULT 'single' CHECK (marital_status IN ('single', 'married', 'widowed', 'divorced')),
+		education_level_override VARCHAR(50) -- NULL to derive the education level from age
 	);`
 
 	applicationsTable := `
@@ -58,7 +78,10 @@ func initTables() {
 		id UUID PRIMARY KEY,
 		applicant_id UUID REFERENCES applicants(id),
 		scheme_id UUID REFERENCES schemes(id),
-		status VARCHAR(50) NOT NULL
+		status VARCHAR(50) NOT NULL,
+		as_of DATE NOT NULL DEFAULT CURRENT_DATE, -- Date eligibility is assessed on
+		decided_at TIMESTAMPTZ, -- When the application was approved, rejected or withdrawn
+		decided_by VARCHAR(255) -- Who made the decision
 	);`
 
 	relationsTable := `
@@ -72,20 +95,38 @@ func initTables() {
 	schemesTable := `
 	CREATE TABLE IF NOT EXISTS schemes (
 		id UUID PRIMARY KEY,
-		name VARCHAR(255) NOT NULL
+		name VARCHAR(255) NOT NULL,
+		status VARCHAR(50) NOT NULL DEFAULT 'open' CHECK (status IN ('draft', 'open', 'closed', 'archived')),
+		open_at DATE, -- NULL if open from the start
+		close_at DATE, -- Last day applications are accepted, NULL if there is no deadline
+		rolling BOOLEAN NOT NULL DEFAULT FALSE, -- The window reopens every year on the same dates
+		max_grants INT CHECK (max_grants > 0), -- Times an applicant can be granted the scheme, NULL for no limit
+		rejection_cooldown_days INT CHECK (rejection_cooldown_days > 0), -- Days before a rejected applicant can apply again
+		grant_cooldown_days INT CHECK (grant_cooldown_days > 0), -- Days before a granted applicant can apply again
+		sla_days INT CHECK (sla_days > 0) -- Days to decide an application before it is overdue
 	);`
 
 	criteriaTable := `CREATE TABLE IF NOT EXISTS criteria (
 		id UUID PRIMARY KEY,
 		marital_status VARCHAR(50) CHECK (marital_status IN ('single', 'married', 'widowed', 'divorced') OR marital_status IS NULL),
 		employment_status VARCHAR(50) CHECK (employment_status IN ('employed', 'unemployed') OR employment_status IS NULL),
-		education_levels TEXT[]
+		education_levels TEXT[],
+		max_household_income_per_capita NUMERIC(12, 2), -- Monthly, NULL if not means-tested
+		max_savings NUMERIC(12, 2)
 	);`
 
 	benefitsTable := `CREATE TABLE IF NOT EXISTS benefits (
 		id UUID PRIMARY KEY,
 		name VARCHAR(255) NOT NULL,
-		amount NUMERIC(10, 2) NOT NULL  -- Benefit amount	
+		amount NUMERIC(10, 2) NOT NULL,  -- Benefit amount, or the percentage for subsidies
+		currency CHAR(3) NOT NULL DEFAULT 'SGD', -- ISO 4217 code
+		type VARCHAR(50) NOT NULL DEFAULT 'cash' CHECK (type IN ('cash', 'voucher', 'in_kind', 'subsidy_percentage')),
+		frequency VARCHAR(50) NOT NULL DEFAULT 'one_off' CHECK (frequency IN ('one_off', 'monthly', 'quarterly')),
+		duration INT NOT NULL DEFAULT 1 CHECK (duration >= 1), -- Number of payments
+		per_child_amount NUMERIC(10, 2),
+		per_household_member_amount NUMERIC(10, 2),
+		max_amount NUMERIC(10, 2), -- Cap on each payment
+		retired_at TIMESTAMPTZ -- Retired benefits stay on existing schemes but cannot be added to new ones
 	);`
 
 	schemeCriteriaTable := `CREATE TABLE IF NOT EXISTS scheme_criteria (
@@ -100,6 +141,268 @@ func initTables() {
 		PRIMARY KEY (scheme_id, benefit_id)
 	);`
 
+	duplicateCandidatesTable := `CREATE TABLE IF NOT EXISTS duplicate_candidates (
+		id UUID PRIMARY KEY,
+		applicant_id1 UUID NOT NULL, -- No foreign keys, so the pair is kept after one of them is merged away
+		applicant_id2 UUID NOT NULL,
+		score NUMERIC(4, 3) NOT NULL,
+		reasons TEXT[] NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'merged', 'dismissed')),
+		detected_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (applicant_id1, applicant_id2)
+	);`
+
+	applicantMergesTable := `CREATE TABLE IF NOT EXISTS applicant_merges (
+		id UUID PRIMARY KEY,
+		survivor_id UUID NOT NULL, -- No foreign keys, so the history outlives both applicants
+		merged_id UUID NOT NULL,
+		applications_moved INT NOT NULL,
+		relations_moved INT NOT NULL,
+		merged_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	financialRecordsTable := `CREATE TABLE IF NOT EXISTS financial_records (
+		id UUID PRIMARY KEY,
+		applicant_id UUID NOT NULL REFERENCES applicants(id) ON DELETE CASCADE,
+		monthly_income NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (monthly_income >= 0),
+		savings NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (savings >= 0),
+		owns_property BOOLEAN NOT NULL DEFAULT FALSE,
+		effective_from DATE NOT NULL, -- Applies until the applicant's next record
+		UNIQUE (applicant_id, effective_from)
+	);`
+
+	maritalStatusHistoryTable := `CREATE TABLE IF NOT EXISTS marital_status_history (
+		id UUID PRIMARY KEY,
+		applicant_id UUID NOT NULL REFERENCES applicants(id) ON DELETE CASCADE,
+		marital_status VARCHAR(50) NOT NULL CHECK (marital_status IN ('single', 'married', 'widowed', 'divorced')),
+		spouse_id UUID, -- The spouse when married, if they are also an applicant
+		effective_from DATE, -- NULL for the status an applicant was registered with
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	schemeVersionsTable := `CREATE TABLE IF NOT EXISTS scheme_versions (
+		id UUID PRIMARY KEY,
+		scheme_id UUID NOT NULL REFERENCES schemes(id) ON DELETE CASCADE,
+		version INT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		effective_from DATE NOT NULL,
+		effective_to DATE, -- Exclusive, NULL while this is the latest version
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (scheme_id, version)
+	);`
+
+	schemeVersionCriteriaTable := `CREATE TABLE IF NOT EXISTS scheme_version_criteria (
+		version_id UUID REFERENCES scheme_versions(id) ON DELETE CASCADE,
+		criteria_id UUID REFERENCES criteria(id) ON DELETE CASCADE,
+		PRIMARY KEY (version_id, criteria_id)
+	);`
+
+	schemeVersionBenefitsTable := `CREATE TABLE IF NOT EXISTS scheme_version_benefits (
+		version_id UUID REFERENCES scheme_versions(id) ON DELETE CASCADE,
+		benefit_id UUID REFERENCES benefits(id) ON DELETE CASCADE,
+		PRIMARY KEY (version_id, benefit_id)
+	);`
+
+	disbursementsTable := `CREATE TABLE IF NOT EXISTS disbursements (
+		id UUID PRIMARY KEY,
+		application_id UUID NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+		benefit_id UUID NOT NULL REFERENCES benefits(id),
+		beneficiary_id UUID REFERENCES applicants(id) ON DELETE SET NULL, -- NULL if the payment is for the applicant
+		payment INT NOT NULL,
+		amount NUMERIC(10, 2) NOT NULL,
+		currency CHAR(3) NOT NULL DEFAULT 'SGD',
+		due_date DATE NOT NULL,
+		status VARCHAR(50) NOT NULL DEFAULT 'scheduled' CHECK (status IN ('scheduled', 'paid', 'cancelled')),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (application_id, benefit_id, payment)
+	);`
+
+	schemeGroupsTable := `CREATE TABLE IF NOT EXISTS scheme_groups (
+		id UUID PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		exclusive BOOLEAN NOT NULL DEFAULT FALSE, -- Only one of the group's schemes can be granted
+		max_combined_amount NUMERIC(12, 2), -- Cap on the total paid across the group's schemes
+		currency CHAR(3) NOT NULL DEFAULT 'SGD',
+		period_months INT CHECK (period_months > 0) -- NULL if the rules apply to all grants
+	);`
+
+	schemeGroupMembersTable := `CREATE TABLE IF NOT EXISTS scheme_group_members (
+		group_id UUID REFERENCES scheme_groups(id) ON DELETE CASCADE,
+		scheme_id UUID REFERENCES schemes(id) ON DELETE CASCADE,
+		PRIMARY KEY (group_id, scheme_id)
+	);`
+
+	applicationBeneficiariesTable := `CREATE TABLE IF NOT EXISTS application_beneficiaries (
+		application_id UUID REFERENCES applications(id) ON DELETE CASCADE,
+		applicant_id UUID REFERENCES applicants(id) ON DELETE CASCADE,
+		benefit_ids UUID[] NOT NULL DEFAULT '{}', -- The benefits paid for this member
+		PRIMARY KEY (application_id, applicant_id)
+	);`
+
+	appealsTable := `CREATE TABLE IF NOT EXISTS appeals (
+		id UUID PRIMARY KEY,
+		application_id UUID NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+		grounds TEXT NOT NULL,
+		status VARCHAR(50) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'upheld', 'overturned')),
+		filed_by VARCHAR(255),
+		reviewer VARCHAR(255), -- Must not be who rejected the application
+		decision_notes TEXT,
+		filed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		assigned_at TIMESTAMPTZ,
+		decided_at TIMESTAMPTZ
+	);`
+
+	applicationStatusHistoryTable := `CREATE TABLE IF NOT EXISTS application_status_history (
+		id UUID PRIMARY KEY,
+		application_id UUID NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+		from_status VARCHAR(50), -- NULL when the application was created
+		to_status VARCHAR(50) NOT NULL,
+		changed_by VARCHAR(255),
+		appeal_id UUID REFERENCES appeals(id) ON DELETE SET NULL, -- Set when an appeal made the change
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	caseworkersTable := `CREATE TABLE IF NOT EXISTS caseworkers (
+		id UUID PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE, -- Matches the X-User header of their requests
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		last_assigned_at TIMESTAMPTZ -- For round-robin assignment
+	);`
+
+	caseworkerSchemesTable := `CREATE TABLE IF NOT EXISTS caseworker_schemes (
+		caseworker_id UUID REFERENCES caseworkers(id) ON DELETE CASCADE,
+		scheme_id UUID REFERENCES schemes(id) ON DELETE CASCADE,
+		PRIMARY KEY (caseworker_id, scheme_id)
+	);`
+
+	applicationNotesTable := `CREATE TABLE IF NOT EXISTS application_notes (
+		id UUID PRIMARY KEY,
+		application_id UUID NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+		author VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL,
+		visibility VARCHAR(50) NOT NULL DEFAULT 'internal' CHECK (visibility IN ('internal', 'applicant')),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	applicationAttachmentsTable := `CREATE TABLE IF NOT EXISTS application_attachments (
+		id UUID PRIMARY KEY,
+		application_id UUID NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+		file_name VARCHAR(255) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size_bytes BIGINT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		storage_key TEXT NOT NULL, -- Where the file is kept in the blob store
+		uploaded_by VARCHAR(255),
+		uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	schemeRequiredDocumentsTable := `CREATE TABLE IF NOT EXISTS scheme_required_documents (
+		scheme_id UUID REFERENCES schemes(id) ON DELETE CASCADE,
+		document_type VARCHAR(100),
+		PRIMARY KEY (scheme_id, document_type)
+	);`
+
+	applicationDocumentsTable := `CREATE TABLE IF NOT EXISTS application_documents (
+		application_id UUID REFERENCES applications(id) ON DELETE CASCADE,
+		document_type VARCHAR(100),
+		attachment_id UUID REFERENCES application_attachments(id) ON DELETE SET NULL, -- The uploaded copy, if there is one
+		status VARCHAR(50) NOT NULL DEFAULT 'submitted' CHECK (status IN ('submitted', 'verified', 'rejected')),
+		submitted_by VARCHAR(255),
+		submitted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		reviewed_by VARCHAR(255),
+		reviewed_at TIMESTAMPTZ,
+		reason TEXT, -- Why it was rejected
+		PRIMARY KEY (application_id, document_type)
+	);`
+
+	outboxEventsTable := `CREATE TABLE IF NOT EXISTS outbox_events (
+		id UUID PRIMARY KEY,
+		event_type VARCHAR(100) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		dispatched_at TIMESTAMPTZ -- When deliveries were created for its subscribers, NULL until then
+	);`
+
+	webhookSubscriptionsTable := `CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id UUID PRIMARY KEY,
+		url TEXT NOT NULL,
+		event_types TEXT[] NOT NULL,
+		secret TEXT NOT NULL, -- Encrypted, used to sign payloads
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	webhookDeliveriesTable := `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id UUID PRIMARY KEY,
+		subscription_id UUID NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+		event_id UUID NOT NULL REFERENCES outbox_events(id) ON DELETE CASCADE,
+		status VARCHAR(50) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ DEFAULT NOW(), -- NULL once delivered or failed
+		last_status_code INT,
+		last_error TEXT,
+		delivered_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	webhookDeliveryAttemptsTable := `CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+		id UUID PRIMARY KEY,
+		delivery_id UUID NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		attempt INT NOT NULL,
+		status_code INT, -- NULL if no response was received
+		error TEXT,
+		duration_ms BIGINT NOT NULL,
+		attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	applicantContactsTable := `CREATE TABLE IF NOT EXISTS applicant_contacts (
+		applicant_id UUID PRIMARY KEY REFERENCES applicants(id) ON DELETE CASCADE,
+		email TEXT, -- Encrypted
+		phone TEXT, -- Encrypted
+		language VARCHAR(10) NOT NULL DEFAULT 'en',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`
+
+	notificationsTable := `CREATE TABLE IF NOT EXISTS notifications (
+		id UUID PRIMARY KEY,
+		applicant_id UUID NOT NULL REFERENCES applicants(id) ON DELETE CASCADE,
+		application_id UUID REFERENCES applications(id) ON DELETE SET NULL,
+		event VARCHAR(100) NOT NULL,
+		channel VARCHAR(50), -- NULL if the applicant could not be reached
+		language VARCHAR(10) NOT NULL,
+		recipient TEXT, -- Encrypted
+		subject TEXT NOT NULL DEFAULT '', -- Encrypted, as messages name the applicant
+		body TEXT NOT NULL DEFAULT '', -- Encrypted
+		status VARCHAR(50) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed', 'skipped')),
+		error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		sent_at TIMESTAMPTZ
+	);`
+
+	outreachJobsTable := `CREATE TABLE IF NOT EXISTS outreach_jobs (
+		id UUID PRIMARY KEY,
+		scheme_id UUID NOT NULL REFERENCES schemes(id) ON DELETE CASCADE,
+		reason VARCHAR(50) NOT NULL CHECK (reason IN ('created', 'criteria_changed', 'new_version', 'opened', 'manual')),
+		status VARCHAR(50) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'skipped', 'failed')),
+		applicants_checked INT NOT NULL DEFAULT 0,
+		matches INT NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		run_after TIMESTAMPTZ NOT NULL DEFAULT NOW(), -- When the scheme next accepts applications under its latest version
+		started_at TIMESTAMPTZ,
+		finished_at TIMESTAMPTZ
+	);`
+
+	outreachMatchesTable := `CREATE TABLE IF NOT EXISTS outreach_matches (
+		id UUID PRIMARY KEY,
+		applicant_id UUID NOT NULL REFERENCES applicants(id) ON DELETE CASCADE,
+		scheme_id UUID NOT NULL REFERENCES schemes(id) ON DELETE CASCADE,
+		version_id UUID NOT NULL REFERENCES scheme_versions(id) ON DELETE CASCADE,
+		job_id UUID NOT NULL REFERENCES outreach_jobs(id) ON DELETE CASCADE,
+		matched_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (applicant_id, scheme_id) -- Applicants are only told about a scheme once
+	);`
+
 	// Execute table creation
 	// We only use := at the start to instantiate the "err" variable
 	_, err := DB.Exec(applicantsTable)
@@ -142,6 +445,271 @@ func initTables() {
 		log.Fatalf("Error creating scheme-benefits table: %v", err)
 	}
 
+	_, err = DB.Exec(duplicateCandidatesTable)
+	if err != nil {
+		log.Fatalf("Error creating duplicate candidates table: %v", err)
+	}
+
+	_, err = DB.Exec(applicantMergesTable)
+	if err != nil {
+		log.Fatalf("Error creating applicant merges table: %v", err)
+	}
+
+	_, err = DB.Exec(financialRecordsTable)
+	if err != nil {
+		log.Fatalf("Error creating financial records table: %v", err)
+	}
+
+	_, err = DB.Exec(maritalStatusHistoryTable)
+	if err != nil {
+		log.Fatalf("Error creating marital status history table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeVersionsTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme versions table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeVersionCriteriaTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme version criteria table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeVersionBenefitsTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme version benefits table: %v", err)
+	}
+
+	_, err = DB.Exec(disbursementsTable)
+	if err != nil {
+		log.Fatalf("Error creating disbursements table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeGroupsTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme groups table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeGroupMembersTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme group members table: %v", err)
+	}
+
+	_, err = DB.Exec(applicationBeneficiariesTable)
+	if err != nil {
+		log.Fatalf("Error creating application beneficiaries table: %v", err)
+	}
+
+	_, err = DB.Exec(appealsTable)
+	if err != nil {
+		log.Fatalf("Error creating appeals table: %v", err)
+	}
+
+	_, err = DB.Exec(applicationStatusHistoryTable)
+	if err != nil {
+		log.Fatalf("Error creating application status history table: %v", err)
+	}
+
+	_, err = DB.Exec(caseworkersTable)
+	if err != nil {
+		log.Fatalf("Error creating caseworkers table: %v", err)
+	}
+
+	_, err = DB.Exec(caseworkerSchemesTable)
+	if err != nil {
+		log.Fatalf("Error creating caseworker schemes table: %v", err)
+	}
+
+	_, err = DB.Exec(applicationNotesTable)
+	if err != nil {
+		log.Fatalf("Error creating application notes table: %v", err)
+	}
+
+	_, err = DB.Exec(applicationAttachmentsTable)
+	if err != nil {
+		log.Fatalf("Error creating application attachments table: %v", err)
+	}
+
+	_, err = DB.Exec(schemeRequiredDocumentsTable)
+	if err != nil {
+		log.Fatalf("Error creating scheme required documents table: %v", err)
+	}
+
+	_, err = DB.Exec(applicationDocumentsTable)
+	if err != nil {
+		log.Fatalf("Error creating application documents table: %v", err)
+	}
+
+	_, err = DB.Exec(outboxEventsTable)
+	if err != nil {
+		log.Fatalf("Error creating outbox events table: %v", err)
+	}
+
+	_, err = DB.Exec(webhookSubscriptionsTable)
+	if err != nil {
+		log.Fatalf("Error creating webhook subscriptions table: %v", err)
+	}
+
+	_, err = DB.Exec(webhookDeliveriesTable)
+	if err != nil {
+		log.Fatalf("Error creating webhook deliveries table: %v", err)
+	}
+
+	_, err = DB.Exec(webhookDeliveryAttemptsTable)
+	if err != nil {
+		log.Fatalf("Error creating webhook delivery attempts table: %v", err)
+	}
+
+	_, err = DB.Exec(applicantContactsTable)
+	if err != nil {
+		log.Fatalf("Error creating applicant contacts table: %v", err)
+	}
+
+	_, err = DB.Exec(notificationsTable)
+	if err != nil {
+		log.Fatalf("Error creating notifications table: %v", err)
+	}
+
+	_, err = DB.Exec(outreachJobsTable)
+	if err != nil {
+		log.Fatalf("Error creating outreach jobs table: %v", err)
+	}
+
+	_, err = DB.Exec(outreachMatchesTable)
+	if err != nil {
+		log.Fatalf("Error creating outreach matches table: %v", err)
+	}
+
+}
+
+// Function to add columns to tables that may have been created by an older version
+// - ADD COLUMN IF NOT EXISTS lets us run these on every start up
+func migrateTables() {
+	migrations := []string{
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS anonymised_at TIMESTAMPTZ`,
+		// Encrypted columns are stored as text
+		`ALTER TABLE applicants ALTER COLUMN name TYPE TEXT`,
+		`ALTER TABLE applicants ALTER COLUMN date_of_birth TYPE TEXT USING date_of_birth::text`,
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS name_index TEXT`,
+		`CREATE INDEX IF NOT EXISTS applicants_name_index ON applicants (name_index)`,
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS national_id TEXT`,
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS national_id_index TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS applicants_national_id_index ON applicants (national_id_index)`,
+		`ALTER TABLE criteria ADD COLUMN IF NOT EXISTS max_household_income_per_capita NUMERIC(12, 2)`,
+		`ALTER TABLE criteria ADD COLUMN IF NOT EXISTS max_savings NUMERIC(12, 2)`,
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS marital_status VARCHAR(50) NOT NULL DEFAULT 'single'
+			CHECK (marital_status IN ('single', 'married', 'widowed', 'divorced'))`,
+		`ALTER TABLE applicants ADD COLUMN IF NOT EXISTS education_level_override VARCHAR(50)`,
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS as_of DATE NOT NULL DEFAULT CURRENT_DATE`,
+		// Added here rather than when creating applications, as scheme_versions is created after it
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS scheme_version_id UUID REFERENCES scheme_versions(id)`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS type VARCHAR(50) NOT NULL DEFAULT 'cash'
+			CHECK (type IN ('cash', 'voucher', 'in_kind', 'subsidy_percentage'))`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS retired_at TIMESTAMPTZ`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS frequency VARCHAR(50) NOT NULL DEFAULT 'one_off'
+			CHECK (frequency IN ('one_off', 'monthly', 'quarterly'))`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS duration INT NOT NULL DEFAULT 1 CHECK (duration >= 1)`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS per_child_amount NUMERIC(10, 2)`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS per_household_member_amount NUMERIC(10, 2)`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS max_amount NUMERIC(10, 2)`,
+		`ALTER TABLE benefits ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'SGD'`,
+		`ALTER TABLE disbursements ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'SGD'`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS status VARCHAR(50) NOT NULL DEFAULT 'open'
+			CHECK (status IN ('draft', 'open', 'closed', 'archived'))`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS open_at DATE`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS close_at DATE`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS rolling BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS max_grants INT CHECK (max_grants > 0)`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS rejection_cooldown_days INT CHECK (rejection_cooldown_days > 0)`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS grant_cooldown_days INT CHECK (grant_cooldown_days > 0)`,
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS sla_days INT CHECK (sla_days > 0)`,
+		// The version scheme_criteria and scheme_benefits are linked to, NULL until it is first linked
+		`ALTER TABLE schemes ADD COLUMN IF NOT EXISTS current_version_id UUID`,
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS decided_at TIMESTAMPTZ`,
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS decided_by VARCHAR(255)`,
+		// Added here rather than when creating applications, as caseworkers is created after it
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS assigned_to UUID REFERENCES caseworkers(id) ON DELETE SET NULL`,
+		`ALTER TABLE applications ADD COLUMN IF NOT EXISTS assigned_at TIMESTAMPTZ`,
+		// Merge history used to be deleted along with the survivor
+		`ALTER TABLE applicant_merges DROP CONSTRAINT IF EXISTS applicant_merges_survivor_id_fkey`,
+		// An application can only have one appeal open at a time
+		`CREATE UNIQUE INDEX IF NOT EXISTS appeals_open_index ON appeals (application_id) WHERE status = 'open'`,
+		`CREATE INDEX IF NOT EXISTS application_status_history_application_index ON application_status_history (application_id, changed_at)`,
+		`ALTER TABLE disbursements ADD COLUMN IF NOT EXISTS beneficiary_id UUID REFERENCES applicants(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS applications_applicant_scheme_index ON applications (applicant_id, scheme_id)`,
+		// An applicant can only have one undecided application to a scheme at a time
+		`CREATE UNIQUE INDEX IF NOT EXISTS applications_open_index ON applications (applicant_id, scheme_id)
+			WHERE status NOT IN ('approved', 'rejected', 'withdrawn')`,
+		`CREATE INDEX IF NOT EXISTS application_notes_application_index ON application_notes (application_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS application_attachments_application_index ON application_attachments (application_id, uploaded_at)`,
+		// The dispatcher looks for events not yet handed out, and deliveries that are due
+		`CREATE INDEX IF NOT EXISTS outbox_events_undispatched_index ON outbox_events (created_at) WHERE dispatched_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_index ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+		`CREATE INDEX IF NOT EXISTS webhook_delivery_attempts_delivery_index ON webhook_delivery_attempts (delivery_id, attempt)`,
+		`CREATE INDEX IF NOT EXISTS notifications_applicant_index ON notifications (applicant_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS notifications_pending_index ON notifications (created_at) WHERE status = 'pending'`,
+		`CREATE INDEX IF NOT EXISTS outreach_jobs_pending_index ON outreach_jobs (run_after) WHERE status IN ('pending', 'running')`,
+	}
+
+	for _, migration := range migrations {
+		_, err := DB.Exec(migration)
+		if err != nil {
+			log.Fatalf("Error migrating tables: %v", err)
+		}
+	}
+}
+
+// Function to fill in rows that new features need for existing data
+// - Each statement only touches rows that have not been filled in yet, so these run on every start up
+func backfillData() {
+	backfills := []string{
+		// Applicants registered before marital status was stored were treated as married if they had a spouse
+		`UPDATE applicants SET marital_status = 'married'
+		WHERE marital_status = 'single'
+		AND id IN (SELECT id1 FROM relations WHERE relation = 'spouse' UNION SELECT id2 FROM relations WHERE relation = 'spouse')
+		AND NOT EXISTS (SELECT 1 FROM marital_status_history WHERE applicant_id = applicants.id)`,
+		// Spouse links go both ways, so that either spouse can be looked up from the other
+		`INSERT INTO relations (id1, id2, relation)
+		SELECT id2, id1, 'spouse' FROM relations WHERE relation = 'spouse'
+		ON CONFLICT DO NOTHING`,
+		// Every applicant starts their history with the status they were registered with
+		`INSERT INTO marital_status_history (id, applicant_id, marital_status)
+		SELECT gen_random_uuid(), id, marital_status FROM applicants
+		WHERE NOT EXISTS (SELECT 1 FROM marital_status_history WHERE applicant_id = applicants.id)`,
+		// Schemes created before versioning become version 1, in effect since records began
+		`INSERT INTO scheme_versions (id, scheme_id, version, name, effective_from)
+		SELECT gen_random_uuid(), id, 1, name, DATE '1900-01-01' FROM schemes
+		WHERE NOT EXISTS (SELECT 1 FROM scheme_versions WHERE scheme_id = schemes.id)`,
+		`INSERT INTO scheme_version_criteria (version_id, criteria_id)
+		SELECT scheme_versions.id, scheme_criteria.criteria_id
+		FROM scheme_versions JOIN scheme_criteria ON scheme_criteria.scheme_id = scheme_versions.scheme_id
+		WHERE scheme_versions.version = 1
+		AND NOT EXISTS (SELECT 1 FROM scheme_version_criteria WHERE version_id = scheme_versions.id)`,
+		`INSERT INTO scheme_version_benefits (version_id, benefit_id)
+		SELECT scheme_versions.id, scheme_benefits.benefit_id
+		FROM scheme_versions JOIN scheme_benefits ON scheme_benefits.scheme_id = scheme_versions.scheme_id
+		WHERE scheme_versions.version = 1
+		AND NOT EXISTS (SELECT 1 FROM scheme_version_benefits WHERE version_id = scheme_versions.id)`,
+		// Applications made before versioning are pinned to the version in effect on their as_of date
+		`UPDATE applications SET scheme_version_id = (
+			SELECT id FROM scheme_versions
+			WHERE scheme_id = applications.scheme_id
+			AND effective_from <= applications.as_of
+			AND (effective_to IS NULL OR effective_to > applications.as_of)
+		)
+		WHERE scheme_version_id IS NULL`,
+		// Applications made before status history was kept start it with their current status
+		`INSERT INTO application_status_history (id, application_id, to_status, changed_by, changed_at)
+		SELECT gen_random_uuid(), id, status, decided_by, COALESCE(decided_at, as_of::timestamptz) FROM applications
+		WHERE NOT EXISTS (SELECT 1 FROM application_status_history WHERE application_id = applications.id)`,
+	}
+
+	for _, backfill := range backfills {
+		_, err := DB.Exec(backfill)
+		if err != nil {
+			log.Fatalf("Error backfilling data: %v", err)
+		}
+	}
 }
 
 // Function to seed initial data
@@ -252,3 +820,132 @@ func seedData() {
 
 	log.Println("Database successfully initialized and seeded.")
 }
+
+// Function to encrypt sensitive applicant fields that are in plaintext or under an old key
+// - Plaintext comes from seed data and from databases created before encryption was added
+// - Rotating ENCRYPTION_ACTIVE_KEY and restarting re-wraps every row under the new key
+func encryptApplicants() {
+	rows, err := DB.Query(`SELECT id, name, date_of_birth, COALESCE(national_id, ''), anonymised_at IS NOT NULL FROM applicants`)
+	if err != nil {
+		log.Fatalf("Error fetching applicants to encrypt: %v", err)
+	}
+
+	type applicantRow struct {
+		id, name, dob, nationalID string
+		anonymised                bool
+	}
+	var pending []applicantRow
+	for rows.Next() {
+		var row applicantRow
+		if err := rows.Scan(&row.id, &row.name, &row.dob, &row.nationalID, &row.anonymised); err != nil {
+			log.Fatalf("Error scanning applicant to encrypt: %v", err)
+		}
+		if !encryption.IsCurrent(row.name) || !encryption.IsCurrent(row.dob) ||
+			(row.nationalID != "" && !encryption.IsCurrent(row.nationalID)) {
+			pending = append(pending, row)
+		}
+	}
+	rows.Close()
+
+	for _, row := range pending {
+		name, err := encryption.Decrypt(row.name)
+		if err != nil {
+			log.Fatalf("Error decrypting applicant %s: %v", row.id, err)
+		}
+		encryptedName, err := encryption.Rotate(row.name)
+		if err != nil {
+			log.Fatalf("Error encrypting applicant %s: %v", row.id, err)
+		}
+		encryptedDOB, err := encryption.Rotate(row.dob)
+		if err != nil {
+			log.Fatalf("Error encrypting applicant %s: %v", row.id, err)
+		}
+
+		// Not every applicant has a national ID yet
+		var encryptedNationalID interface{}
+		if row.nationalID != "" {
+			encryptedNationalID, err = encryption.Rotate(row.nationalID)
+			if err != nil {
+				log.Fatalf("Error encrypting applicant %s: %v", row.id, err)
+			}
+		}
+
+		// Anonymised applicants keep an empty blind index so they cannot be looked up by name
+		nameIndex := interface{}(encryption.BlindIndex(name))
+		if row.anonymised {
+			nameIndex = nil
+		}
+
+		_, err = DB.Exec(`UPDATE applicants SET name = $1, name_index = $2, date_of_birth = $3, national_id = $4 WHERE id = $5`,
+			encryptedName, nameIndex, encryptedDOB, encryptedNationalID, row.id)
+		if err != nil {
+			log.Fatalf("Error saving encrypted applicant %s: %v", row.id, err)
+		}
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Encrypted %d applicant(s).", len(pending))
+	}
+}
+
+// Function to encrypt the personal fields of other tables that are in plaintext or under an old key
+// - Rows are found by their key column, and NULL or empty values are left as they are
+// - Like encryptApplicants, this lets a retired key be removed once every row has been re-wrapped
+func rotateEncryptedColumns(table, key string, columns ...string) {
+	rows, err := DB.Query(fmt.Sprintf(`SELECT %s::text, %s FROM %s`, key, strings.Join(columns, ", "), table))
+	if err != nil {
+		log.Fatalf("Error fetching %s to encrypt: %v", table, err)
+	}
+
+	type encryptedRow struct {
+		key    string
+		values []sql.NullString
+	}
+	var pending []encryptedRow
+	for rows.Next() {
+		row := encryptedRow{values: make([]sql.NullString, len(columns))}
+		dest := []interface{}{&row.key}
+		for i := range row.values {
+			dest = append(dest, &row.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Fatalf("Error scanning %s to encrypt: %v", table, err)
+		}
+		for _, value := range row.values {
+			if value.Valid && value.String != "" && !encryption.IsCurrent(value.String) {
+				pending = append(pending, row)
+				break
+			}
+		}
+	}
+	rows.Close()
+
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = fmt.Sprintf("%s = $%d", column, i+1)
+	}
+	query := fmt.Sprintf(`UPDATE %s SET %s WHERE %s = $%d`, table, strings.Join(assignments, ", "), key, len(columns)+1)
+
+	for _, row := range pending {
+		values := make([]interface{}, 0, len(columns)+1)
+		for _, value := range row.values {
+			if !value.Valid || value.String == "" {
+				values = append(values, value)
+				continue
+			}
+			rotated, err := encryption.Rotate(value.String)
+			if err != nil {
+				log.Fatalf("Error encrypting %s %s: %v", table, row.key, err)
+			}
+			values = append(values, rotated)
+		}
+		values = append(values, row.key)
+		if _, err := DB.Exec(query, values...); err != nil {
+			log.Fatalf("Error saving encrypted %s %s: %v", table, row.key, err)
+		}
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Encrypted %d row(s) of %s.", len(pending), table)
+	}
+}
@@ -0,0 +1,211 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Every encrypted value starts with this prefix, so that plaintext left over from
+// before encryption was turned on can still be read and encrypted later
+const prefix = "enc:v1:"
+
+// Key-encryption keys by ID, the ID of the key used for new values, and the key for blind indexes
+var (
+	keys        map[string][]byte
+	activeKeyID string
+	indexKey    []byte
+)
+
+// Function to load the keys from our .env variables
+// - ENCRYPTION_KEYS is a comma separated list of id:base64key pairs, each key 32 bytes long
+// - ENCRYPTION_ACTIVE_KEY is the ID of the key used to encrypt new values
+// - BLIND_INDEX_KEY is a base64 key used to build lookup indexes over encrypted values
+func Init() {
+	keys = make(map[string][]byte)
+	for _, pair := range strings.Split(os.Getenv("ENCRYPTION_KEYS"), ",") {
+		id, encoded, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			log.Fatal("ENCRYPTION_KEYS must be a comma separated list of id:base64key pairs")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			log.Fatalf("Encryption key %q must be 32 bytes encoded in base64", id)
+		}
+		keys[id] = key
+	}
+
+	activeKeyID = os.Getenv("ENCRYPTION_ACTIVE_KEY")
+	if _, ok := keys[activeKeyID]; !ok {
+		log.Fatalf("ENCRYPTION_ACTIVE_KEY %q is not one of ENCRYPTION_KEYS", activeKeyID)
+	}
+
+	var err error
+	indexKey, err = base64.StdEncoding.DecodeString(os.Getenv("BLIND_INDEX_KEY"))
+	if err != nil || len(indexKey) < 32 {
+		log.Fatal("BLIND_INDEX_KEY must be at least 32 bytes encoded in base64")
+	}
+}
+
+// Encrypt a value with a fresh data key, and wrap the data key with the active key-encryption key
+// - Output format is enc:v1:<key id>:<wrapped data key>:<ciphertext>
+func Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(keys[activeKeyID], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + activeKeyID + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt a value produced by Encrypt
+// - Values without the prefix are returned as they are, as they were stored before encryption
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	keyID, wrappedKey, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rotate re-wraps the data key of a value with the active key-encryption key
+// - The ciphertext itself does not change, and plaintext values are encrypted
+func Rotate(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return Encrypt(value)
+	}
+
+	keyID, wrappedKey, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+	if keyID == activeKeyID {
+		return value, nil
+	}
+	dataKey, err := unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	rewrapped, err := seal(keys[activeKeyID], dataKey)
+	if err != nil {
+		return "", err
+	}
+	return prefix + activeKeyID + ":" +
+		base64.StdEncoding.EncodeToString(rewrapped) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Check whether a value has been encrypted
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Check whether a value is encrypted under the active key-encryption key
+func IsCurrent(value string) bool {
+	return strings.HasPrefix(value, prefix+activeKeyID+":")
+}
+
+// BlindIndex returns a keyed hash of a value, so that encrypted columns can be looked up by exact match
+// - Values are trimmed and upper-cased first, so lookups ignore case and surrounding spaces
+func BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(strings.ToUpper(strings.TrimSpace(value))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Split an encrypted value into its key ID, wrapped data key and ciphertext
+func split(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("malformed encrypted value")
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed wrapped key: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed ciphertext: %v", err)
+	}
+	return parts[0], wrappedKey, ciphertext, nil
+}
+
+// Unwrap a data key with the key-encryption key it was wrapped with
+func unwrap(keyID string, wrappedKey []byte) ([]byte, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	return open(key, wrappedKey)
+}
+
+// Encrypt with AES-GCM, prepending the random nonce to the ciphertext
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt AES-GCM output produced by seal
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
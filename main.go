@@ -6,20 +6,47 @@ import (
 	"log"
 
 	"github.com/neozhixuan/gt_assessment/config"
+	"github.com/neozhixuan/gt_assessment/controllers"
 	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+	"github.com/neozhixuan/gt_assessment/notifications"
 	"github.com/neozhixuan/gt_assessment/routes"
+	"github.com/neozhixuan/gt_assessment/storage"
+	"github.com/neozhixuan/gt_assessment/webhooks"
 )
 
 func main() {
 	// Load our .env variables
 	config.LoadEnv()
 
+	// Load the age bands used to derive education levels
+	config.LoadEducationLevels()
+
+	// Load the keys used to encrypt sensitive applicant fields
+	encryption.Init()
+
+	// Set up where uploaded files are kept
+	storage.Init()
+
 	// Initialize database connection
 	database.InitDB()
 
 	// Close the DB connection when the app stops
 	defer database.DB.Close()
 
+	// Send webhooks for the events recorded in the outbox
+	webhooks.StartDispatcher()
+
+	// Send the notifications queued for applicants
+	notifications.Init()
+	notifications.StartSender()
+
+	// Look for applicants who qualify for new or changed schemes
+	controllers.StartOutreachJobs()
+
+	// Make scheme versions current on the day they take effect
+	controllers.StartVersionPromotion()
+
 	// Set up routes
 	r := routes.SetupRouter()
 
@@ -0,0 +1,38 @@
+package models
+
+// Appeal contests the rejection of an application
+// - It is reviewed by someone other than whoever rejected the application
+type Appeal struct {
+	ID            string  `json:"id"`
+	ApplicationID string  `json:"application_id"`
+	Grounds       string  `json:"grounds"`
+	Status        string  `json:"status"` // open, upheld or overturned
+	FiledBy       *string `json:"filed_by,omitempty"`
+	Reviewer      *string `json:"reviewer,omitempty"`
+	DecisionNotes *string `json:"decision_notes,omitempty"`
+	FiledAt       string  `json:"filed_at"`
+	AssignedAt    *string `json:"assigned_at,omitempty"`
+	DecidedAt     *string `json:"decided_at,omitempty"`
+}
+
+// AppealAssignment is the request body for assigning an appeal to a reviewer
+type AppealAssignment struct {
+	Reviewer string `json:"reviewer"`
+}
+
+// AppealDecision is the request body for deciding an appeal
+type AppealDecision struct {
+	Outcome string `json:"outcome"` // upheld keeps the rejection, overturned approves the application
+	Notes   string `json:"notes"`
+}
+
+// StatusChange is one entry in an application's status history
+type StatusChange struct {
+	ID            string  `json:"id"`
+	ApplicationID string  `json:"application_id"`
+	FromStatus    *string `json:"from_status"` // nil when the application was created
+	ToStatus      string  `json:"to_status"`
+	ChangedBy     *string `json:"changed_by,omitempty"`
+	AppealID      *string `json:"appeal_id,omitempty"` // Set when an appeal made the change
+	ChangedAt     string  `json:"changed_at"`
+}
@@ -2,17 +2,68 @@ package models
 
 // DB Schema
 type Applicant struct {
-	ID               string `json:"id"`
-	Name             string `json:"name"`
-	EmploymentStatus string `json:"employment_status"`
-	Sex              string `json:"sex"`
-	DateOfBirth      string `json:"date_of_birth"`
+	ID                     string  `json:"id"`
+	Name                   string  `json:"name"`
+	EmploymentStatus       string  `json:"employment_status"`
+	Sex                    string  `json:"sex"`
+	DateOfBirth            string  `json:"date_of_birth"`
+	NationalID             string  `json:"national_id,omitempty"`              // NRIC/FIN, e.g. S1234567D
+	MaritalStatus          string  `json:"marital_status"`                     // single, married, widowed, divorced
+	EducationLevel         string  `json:"education_level,omitempty"`          // Derived from age, or the override
+	EducationLevelOverride *string `json:"education_level_override,omitempty"` // Set explicitly, e.g. for a child held back a year
+	AnonymisedAt           *string `json:"anonymised_at,omitempty"`            // Set once personal data has been scrubbed
 }
 
 // Response Schema
 type ApplicantResponse struct {
-	ID               string   `json:"id"`
-	MaritalStatus    string   `json:"marital_status"`
-	EmploymentStatus string   `json:"employment_status"`
-	ChildrenLevel    []string `json:"children_level"`
+	ID               string            `json:"id"`
+	MaritalStatus    string            `json:"marital_status"`
+	EmploymentStatus string            `json:"employment_status"`
+	ChildrenLevel    []string          `json:"children_level"`
+	ChildrenCount    int               `json:"children_count"`
+	Finances         HouseholdFinances `json:"finances"`
+}
+
+// Response sent when an applicant is registered twice
+type DuplicateApplicantResponse struct {
+	Error               string `json:"error"`
+	ExistingApplicantID string `json:"existing_applicant_id"`
+}
+
+// Relation links two applicants in the same household
+// - ID2 is related to ID1 via Relation (e.g. child, spouse)
+type Relation struct {
+	ID1      string `json:"id1"`
+	ID2      string `json:"id2"`
+	Relation string `json:"relation"`
+}
+
+// MaritalStatusChange is one entry in an applicant's marital status history
+// - It is also the request body for changing an applicant's marital status
+type MaritalStatusChange struct {
+	ID            string  `json:"id"`
+	ApplicantID   string  `json:"applicant_id"`
+	MaritalStatus string  `json:"marital_status"`
+	SpouseID      *string `json:"spouse_id,omitempty"`      // Set when marrying another applicant
+	EffectiveFrom *string `json:"effective_from,omitempty"` // YYYY-MM-DD, nil for the status the applicant was registered with
+	RecordedAt    string  `json:"recorded_at"`
+}
+
+// ApplicantExport is everything we hold about one applicant, for subject access requests
+type ApplicantExport struct {
+	ExportedAt           string                `json:"exported_at"`
+	Applicant            Applicant             `json:"applicant"`
+	Relations            []Relation            `json:"relations"`
+	Applications         []Application         `json:"applications"`
+	FinancialRecords     []FinancialRecord     `json:"financial_records"`
+	MaritalStatusHistory []MaritalStatusChange `json:"marital_status_history"`
+	Disbursements        []Disbursement        `json:"disbursements"`
+	Appeals              []Appeal              `json:"appeals"`
+	StatusHistory        []StatusChange        `json:"status_history"` // Of the applicant's applications
+	Merges               []ApplicantMerge      `json:"merges"`         // Duplicates merged into the applicant, or the applicant into another
+	Notes                []Note                `json:"notes"`          // Only those shared with the applicant
+	Attachments          []Attachment          `json:"attachments"`    // The files themselves are downloaded separately
+	Contact              *ApplicantContact     `json:"contact"`
+	Notifications        []Notification        `json:"notifications"`
+	OutreachMatches      []OutreachMatch       `json:"outreach_matches"`
 }
@@ -1,8 +1,32 @@
 package models
 
 type Application struct {
-	ID          string `json:"id"`
-	ApplicantID string `json:"applicant_id"`
-	SchemeID    string `json:"scheme_id"`
-	Status      string `json:"status"`
+	ID              string  `json:"id"`
+	ApplicantID     string  `json:"applicant_id"`
+	SchemeID        string  `json:"scheme_id"`
+	Status          string  `json:"status"`
+	AsOf            string  `json:"as_of"`                       // YYYY-MM-DD date eligibility is assessed on, defaults to the day of application
+	SchemeVersionID string  `json:"scheme_version_id,omitempty"` // The scheme version in effect on as_of, set by the server
+	DecidedAt       *string `json:"decided_at,omitempty"`        // When it was approved, rejected or withdrawn, set by the server
+	DecidedBy       *string `json:"decided_by,omitempty"`        // Who decided it, from the X-User header
+	AssignedTo      *string `json:"assigned_to,omitempty"`       // The caseworker working on it
+	// Household members the application is made for, nil to apply for the whole household
+	Beneficiaries []ApplicationBeneficiary `json:"beneficiaries,omitempty"`
+}
+
+// ApplicationBeneficiary is a member of the applicant's household that an application is made for
+// - Only the children among them count towards eligibility and per child amounts
+type ApplicationBeneficiary struct {
+	ApplicantID string   `json:"applicant_id"`
+	Relation    string   `json:"relation"`              // How they are related to the applicant, set by the server
+	BenefitIDs  []string `json:"benefit_ids,omitempty"` // The scheme's benefits paid for this member, the rest are for the applicant
+}
+
+// ApplicationEligibility is whether an application's applicant was eligible for its scheme on its as_of date
+type ApplicationEligibility struct {
+	ApplicationID string `json:"application_id"`
+	ApplicantID   string `json:"applicant_id"`
+	SchemeID      string `json:"scheme_id"`
+	AsOf          string `json:"as_of"`
+	Eligible      bool   `json:"eligible"`
 }
@@ -0,0 +1,39 @@
+package models
+
+// Caseworker works on applications
+// - A caseworker with schemes is only assigned applications to those schemes, one without is assigned any
+type Caseworker struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"` // Matches the X-User header of their requests
+	Active           bool     `json:"active"`
+	SchemeIDs        []string `json:"scheme_ids"`
+	OpenApplications int      `json:"open_applications"` // Undecided applications assigned to them, set by the server
+}
+
+// CaseworkerUpdate is a change to a caseworker, where fields that are left out are kept as they are
+type CaseworkerUpdate struct {
+	Name      string    `json:"name"`
+	Active    *bool     `json:"active"`
+	SchemeIDs *[]string `json:"scheme_ids"`
+}
+
+// Assignment is the request body for assigning applications to caseworkers
+// - Either names the caseworker, or the strategy used to pick one: round_robin or least_loaded
+type Assignment struct {
+	CaseworkerID string `json:"caseworker_id"`
+	Strategy     string `json:"strategy"`
+}
+
+// AssignmentResult is an application that was assigned to a caseworker
+type AssignmentResult struct {
+	ApplicationID string `json:"application_id"`
+	CaseworkerID  string `json:"caseworker_id"`
+}
+
+// QueuedApplication is an application in a work queue, with how long it has to be decided
+type QueuedApplication struct {
+	Application
+	SubmittedAt string  `json:"submitted_at"` // When the application was created, from its status history
+	DueAt       *string `json:"due_at"`       // When it must be decided by, nil if its scheme has no SLA
+	Breached    bool    `json:"breached"`     // Whether it was, or is still, undecided after it was due
+}
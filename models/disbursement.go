@@ -0,0 +1,23 @@
+package models
+
+// Disbursement is one payment of a benefit under an approved application
+type Disbursement struct {
+	ID            string  `json:"id"`
+	ApplicationID string  `json:"application_id"`
+	BenefitID     string  `json:"benefit_id"`
+	BeneficiaryID *string `json:"beneficiary_id,omitempty"` // The household member the payment is for, nil if it is for the applicant
+	Payment       int     `json:"payment"`                  // 1 for the first payment of the benefit, 2 for the second, and so on
+	Amount        Money   `json:"amount"`
+	Currency      string  `json:"currency"`
+	DueDate       string  `json:"due_date"` // YYYY-MM-DD
+	Status        string  `json:"status"`   // scheduled, paid or cancelled
+	CreatedAt     string  `json:"created_at"`
+}
+
+// DisbursementTotal is the sum of the disbursements in one currency with one status
+type DisbursementTotal struct {
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+	Count    int    `json:"count"`
+	Total    Money  `json:"total"`
+}
@@ -0,0 +1,33 @@
+package models
+
+// ApplicationDocument is a supporting document submitted for an application, or one its scheme requires that is still missing
+type ApplicationDocument struct {
+	DocumentType string  `json:"document_type"` // e.g. retrenchment_letter
+	Required     bool    `json:"required"`      // Whether the application's scheme requires it
+	Status       string  `json:"status"`        // missing, submitted, verified or rejected
+	AttachmentID *string `json:"attachment_id,omitempty"`
+	SubmittedBy  *string `json:"submitted_by,omitempty"`
+	SubmittedAt  *string `json:"submitted_at,omitempty"`
+	ReviewedBy   *string `json:"reviewed_by,omitempty"`
+	ReviewedAt   *string `json:"reviewed_at,omitempty"`
+	Reason       *string `json:"reason,omitempty"` // Why it was rejected
+}
+
+// DocumentChecklist is where an application stands on the documents its scheme requires
+type DocumentChecklist struct {
+	ApplicationID string                `json:"application_id"`
+	Complete      bool                  `json:"complete"` // Every required document has been verified
+	Documents     []ApplicationDocument `json:"documents"`
+}
+
+// DocumentSubmission is the request body for submitting a document for an application
+type DocumentSubmission struct {
+	DocumentType string  `json:"document_type"`
+	AttachmentID *string `json:"attachment_id"` // The uploaded copy, if there is one
+}
+
+// DocumentReview is the request body for verifying or rejecting a submitted document
+type DocumentReview struct {
+	Status string `json:"status"` // verified or rejected
+	Reason string `json:"reason"` // Required when rejecting
+}
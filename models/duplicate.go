@@ -0,0 +1,22 @@
+package models
+
+// DuplicateCandidate is a pair of applicants that may be the same person, waiting for review
+type DuplicateCandidate struct {
+	ID           string   `json:"id"`
+	ApplicantID1 string   `json:"applicant_id1"`
+	ApplicantID2 string   `json:"applicant_id2"`
+	Score        float64  `json:"score"`   // 0 to 1, higher means more likely to be the same person
+	Reasons      []string `json:"reasons"` // What contributed to the score, e.g. same_date_of_birth
+	Status       string   `json:"status"`  // pending, merged, dismissed
+	DetectedAt   string   `json:"detected_at"`
+}
+
+// ApplicantMerge records one applicant being merged into another
+type ApplicantMerge struct {
+	ID                string `json:"id"`
+	SurvivorID        string `json:"survivor_id"`
+	MergedID          string `json:"merged_id"`
+	ApplicationsMoved int    `json:"applications_moved"`
+	RelationsMoved    int    `json:"relations_moved"`
+	MergedAt          string `json:"merged_at"`
+}
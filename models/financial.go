@@ -0,0 +1,19 @@
+package models
+
+// FinancialRecord is an applicant's income and assets from a given date, until their next record
+type FinancialRecord struct {
+	ID            string `json:"id"`
+	ApplicantID   string `json:"applicant_id"`
+	MonthlyIncome Money  `json:"monthly_income"` // In the default currency, as are savings
+	Savings       Money  `json:"savings"`
+	OwnsProperty  bool   `json:"owns_property"`
+	EffectiveFrom string `json:"effective_from"` // YYYY-MM-DD
+}
+
+// HouseholdFinances summarises the financial records of an applicant's household on a date
+// - Fields are nil when nobody in the household has a financial record yet
+type HouseholdFinances struct {
+	HouseholdSize            int    `json:"household_size"`
+	HouseholdIncomePerCapita *Money `json:"household_income_per_capita"`
+	Savings                  *Money `json:"savings"` // The applicant's own savings
+}
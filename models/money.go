@@ -0,0 +1,124 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Currency used for amounts that do not carry their own, such as incomes and means-test thresholds
+const DefaultCurrency = "SGD"
+
+// Money is an amount in cents, so that sums and totals are exact
+// - It is written to JSON as a number with 2 decimal places, e.g. 123.45, and to Postgres as a NUMERIC
+// - It does not hold a currency, which is stored next to it where amounts can be in different currencies
+type Money int64
+
+// Parse an amount such as "123.45" or "-5", with at most 2 decimal places
+func ParseMoney(value string) (Money, error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(value, "-")
+
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" || len(fraction) > 2 || strings.ContainsAny(whole+fraction, "+-eE") {
+		return 0, fmt.Errorf("invalid amount %q, expected a number with at most 2 decimal places", value)
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+
+	cents, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q, expected a number with at most 2 decimal places", value)
+	}
+	if negative {
+		cents = -cents
+	}
+	return Money(cents), nil
+}
+
+// Format the amount with 2 decimal places
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Multiply the amount by a whole number, e.g. a per child amount by the number of children
+func (m Money) Times(n int) Money {
+	return m * Money(n)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Accepts a JSON number or a string, so that clients can avoid floating point entirely
+func (m *Money) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseMoney(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan a NUMERIC column, which the driver returns as text
+func (m *Money) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case []byte:
+		return m.scanText(string(value))
+	case string:
+		return m.scanText(value)
+	case int64:
+		*m = Money(value * 100)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+// NUMERIC columns may be returned with more decimal places than we keep, e.g. from AVG, so round half away from zero
+func (m *Money) scanText(value string) error {
+	whole, fraction, _ := strings.Cut(value, ".")
+	if len(fraction) <= 2 {
+		parsed, err := ParseMoney(value)
+		*m = parsed
+		return err
+	}
+
+	parsed, err := ParseMoney(whole + "." + fraction[:2])
+	if err != nil {
+		return err
+	}
+	if fraction[2] >= '5' {
+		if strings.HasPrefix(value, "-") {
+			parsed--
+		} else {
+			parsed++
+		}
+	}
+	*m = parsed
+	return nil
+}
+
+// Write the amount as text, which Postgres reads into a NUMERIC exactly
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
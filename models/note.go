@@ -0,0 +1,24 @@
+package models
+
+// Note is a caseworker's note on an application, such as a record of an interview
+type Note struct {
+	ID            string `json:"id"`
+	ApplicationID string `json:"application_id"`
+	Author        string `json:"author"`
+	Body          string `json:"body"`
+	Visibility    string `json:"visibility"` // internal for caseworkers only, or applicant to share it with the applicant
+	CreatedAt     string `json:"created_at"`
+}
+
+// Attachment is a file, such as a payslip, uploaded in support of an application
+// - The file itself is kept in the blob store, and can be checked against its checksum
+type Attachment struct {
+	ID            string  `json:"id"`
+	ApplicationID string  `json:"application_id"`
+	FileName      string  `json:"file_name"`
+	ContentType   string  `json:"content_type"`
+	SizeBytes     int64   `json:"size_bytes"`
+	SHA256        string  `json:"sha256"`
+	UploadedBy    *string `json:"uploaded_by,omitempty"`
+	UploadedAt    string  `json:"uploaded_at"`
+}
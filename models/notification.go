@@ -0,0 +1,27 @@
+package models
+
+// ApplicantContact is how an applicant is reached, and the language they are written to in
+type ApplicantContact struct {
+	ApplicantID string  `json:"applicant_id"`
+	Email       *string `json:"email"` // An empty string removes it
+	Phone       *string `json:"phone"` // For SMS, e.g. +6591234567
+	Language    string  `json:"language"`
+	UpdatedAt   *string `json:"updated_at,omitempty"`
+}
+
+// Notification is one message sent, or to be sent, to an applicant
+type Notification struct {
+	ID            string  `json:"id"`
+	ApplicantID   string  `json:"applicant_id"`
+	ApplicationID *string `json:"application_id,omitempty"`
+	Event         string  `json:"event"`   // e.g. application.approved
+	Channel       *string `json:"channel"` // email or sms, nil if the applicant could not be reached
+	Language      string  `json:"language"`
+	Recipient     *string `json:"recipient,omitempty"`
+	Subject       string  `json:"subject,omitempty"`
+	Body          string  `json:"body"`
+	Status        string  `json:"status"` // pending, sent, failed, or skipped if the applicant has no contact details
+	Error         *string `json:"error,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	SentAt        *string `json:"sent_at,omitempty"`
+}
@@ -0,0 +1,27 @@
+package models
+
+// OutreachJob is a run through the applicants, looking for those who qualify for a scheme but have not applied to it
+type OutreachJob struct {
+	ID                string  `json:"id"`
+	SchemeID          string  `json:"scheme_id"`
+	Reason            string  `json:"reason"` // created, criteria_changed, new_version, opened or manual
+	Status            string  `json:"status"` // pending, running, done, skipped if the scheme is not accepting applications, or failed
+	ApplicantsChecked int     `json:"applicants_checked"`
+	Matches           int     `json:"matches"` // New matches found, not counting applicants matched before
+	Error             *string `json:"error,omitempty"`
+	CreatedAt         string  `json:"created_at"`
+	RunAfter          string  `json:"run_after"` // Jobs wait until the scheme accepts applications under its latest version
+	StartedAt         *string `json:"started_at,omitempty"`
+	FinishedAt        *string `json:"finished_at,omitempty"`
+}
+
+// OutreachMatch is an applicant found to qualify for a scheme they had not applied to
+// - An applicant is only matched to a scheme once, so they are not told about it twice
+type OutreachMatch struct {
+	ID          string `json:"id"`
+	ApplicantID string `json:"applicant_id"`
+	SchemeID    string `json:"scheme_id"`
+	VersionID   string `json:"version_id"` // The version they qualified under
+	JobID       string `json:"job_id"`
+	MatchedAt   string `json:"matched_at"`
+}
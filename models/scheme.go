@@ -2,40 +2,150 @@ package models
 
 // Scheme represents a financial assistance scheme.
 type Scheme struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	CriteriaIDs []string `json:"criteria_ids"` // References to criteria table
-	BenefitIDs  []string `json:"benefit_ids"`  // References to benefits table
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	CriteriaIDs  []string      `json:"criteria_ids"`         // References to criteria table
+	BenefitIDs   []string      `json:"benefit_ids"`          // References to benefits table
+	VersionID    string        `json:"version_id,omitempty"` // The version in effect, when looking up eligibility
+	Version      int           `json:"version,omitempty"`
+	Criteria     []Criteria    `json:"criteria,omitempty"` // The criteria and benefits themselves, when returning a single scheme
+	Benefits     []Benefit     `json:"benefits,omitempty"`
+	Entitlements []Entitlement `json:"entitlements,omitempty"` // What the applicant would receive, when looking up eligibility
+	SchemeWindow
+	ApplicationLimits
+	RequiredDocuments     []string       `json:"required_documents"`               // Document types applicants must have verified
+	AcceptingApplications *bool          `json:"accepting_applications,omitempty"` // Whether the window is open, when looking up eligibility
+	ExcludedBy            *GroupConflict `json:"excluded_by,omitempty"`            // Eligible, but excluded by an existing grant
+}
+
+// SchemeWindow is when a scheme accepts applications
+type SchemeWindow struct {
+	Status  string  `json:"status"`   // draft, open, closed or archived, only open schemes accept applications
+	OpenAt  *string `json:"open_at"`  // YYYY-MM-DD, nil if open from the start
+	CloseAt *string `json:"close_at"` // YYYY-MM-DD, the last day applications are accepted, nil if there is no deadline
+	Rolling bool    `json:"rolling"`  // The window reopens every year on the same dates
+}
+
+// ApplicationLimits is how often an applicant can apply for and be granted a scheme, and how quickly applications must be decided
+// - Each limit is nil if the scheme has none
+type ApplicationLimits struct {
+	MaxGrants             *int `json:"max_grants"`              // Times an applicant can be granted the scheme
+	RejectionCooldownDays *int `json:"rejection_cooldown_days"` // Days after a rejection before the applicant can apply again
+	GrantCooldownDays     *int `json:"grant_cooldown_days"`     // Days after a grant before the applicant can apply again
+	SLADays               *int `json:"sla_days"`                // Days from application to decision before it is overdue
 }
 
 // Criteria represents the conditions for eligibility.
 type Criteria struct {
-	ID               string   `json:"id"`
-	MaritalStatus    string   `json:"marital_status"`    // Single, Married, Widowed, Divorced
-	EmploymentStatus string   `json:"employment_status"` // Employed, Unemployed
-	EducationLevels  []string `json:"education_levels"`
+	ID                          string   `json:"id"`
+	MaritalStatus               string   `json:"marital_status"`    // Single, Married, Widowed, Divorced
+	EmploymentStatus            string   `json:"employment_status"` // Employed, Unemployed
+	EducationLevels             []string `json:"education_levels"`
+	MaxHouseholdIncomePerCapita *Money   `json:"max_household_income_per_capita,omitempty"` // Monthly in the default currency, for means-tested schemes
+	MaxSavings                  *Money   `json:"max_savings,omitempty"`
 }
 
 // Benefit represents the benefits that can be granted under a scheme.
+// - The amount of each payment is Amount, plus the per child and per household member amounts, up to MaxAmount
 type Benefit struct {
-	ID     string  `json:"id"`
-	Name   string  `json:"name"`
-	Amount float64 `json:"amount"` // Monetary value of the benefit
+	ID                       string  `json:"id"`
+	Name                     string  `json:"name"`
+	Amount                   Money   `json:"amount"`    // Monetary value of the benefit, or the percentage for subsidies
+	Currency                 string  `json:"currency"`  // ISO 4217 code, defaults to SGD
+	Type                     string  `json:"type"`      // cash, voucher, in_kind or subsidy_percentage
+	Frequency                string  `json:"frequency"` // one_off, monthly or quarterly
+	Duration                 int     `json:"duration"`  // Number of payments, 1 for one-off benefits
+	PerChildAmount           *Money  `json:"per_child_amount,omitempty"`
+	PerHouseholdMemberAmount *Money  `json:"per_household_member_amount,omitempty"`
+	MaxAmount                *Money  `json:"max_amount,omitempty"` // Cap on each payment
+	RetiredAt                *string `json:"retired_at,omitempty"`
+}
+
+// BenefitUpdate is a change to a catalogue benefit, where fields that are left out are kept as they are
+// - A tier amount or cap of 0 removes it
+type BenefitUpdate struct {
+	Name                     string `json:"name"`
+	Amount                   *Money `json:"amount"`
+	Currency                 string `json:"currency"`
+	Type                     string `json:"type"`
+	Frequency                string `json:"frequency"`
+	Duration                 int    `json:"duration"`
+	PerChildAmount           *Money `json:"per_child_amount"`
+	PerHouseholdMemberAmount *Money `json:"per_household_member_amount"`
+	MaxAmount                *Money `json:"max_amount"`
+}
+
+// Entitlement is what a benefit works out to for a particular applicant
+type Entitlement struct {
+	BenefitID        string `json:"benefit_id"`
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	Frequency        string `json:"frequency"`
+	Duration         int    `json:"duration"`
+	Currency         string `json:"currency"`
+	AmountPerPayment Money  `json:"amount_per_payment"` // The percentage for subsidies
+	Total            *Money `json:"total"`              // nil for subsidies, which have no fixed value
+}
+
+// SchemeInput is one scheme when creating it, or when publishing a new version of it
+type SchemeInput struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	EffectiveFrom string    `json:"effective_from"` // YYYY-MM-DD, defaults to today
+	Criteria      Criteria  `json:"criteria"`
+	Benefits      []Benefit `json:"benefits"`
+	SchemeWindow
+	ApplicationLimits
+	RequiredDocuments []string `json:"required_documents"` // Only used when creating the scheme, as they are not versioned
+}
+
+// SchemeUpdate is a change to a scheme's latest version
+// - Criteria and benefits that are left out are kept as they are
+type SchemeUpdate struct {
+	Name     string     `json:"name"`
+	Criteria *Criteria  `json:"criteria"`
+	Benefits *[]Benefit `json:"benefits"` // An empty list unlinks every benefit
+	Status   string     `json:"status"`
+	OpenAt   *string    `json:"open_at"` // An empty string removes the date
+	CloseAt  *string    `json:"close_at"`
+	Rolling  *bool      `json:"rolling"`
+	// An empty list removes every required document
+	RequiredDocuments *[]string `json:"required_documents"`
+	// A limit of 0 removes it
+	ApplicationLimits
 }
 
 type SchemesRequest struct {
-	Schemes []struct {
-		ID       string `json:"id"`
-		Name     string `json:"name"`
-		Criteria struct {
-			MaritalStatus    string   `json:"marital_status"`    // Single, Married, Widowed, Divorced
-			EmploymentStatus string   `json:"employment_status"` // Employed, Unemployed
-			EducationLevels  []string `json:"education_levels"`
-		} `json:"criteria"`
-		Benefits []struct {
-			ID     string  `json:"id"`
-			Name   string  `json:"name"`
-			Amount float64 `json:"amount"`
-		} `json:"benefits"`
-	} `json:"schemes"`
+	Schemes []SchemeInput `json:"schemes"`
+}
+
+// SchemeVersion is a scheme's name, criteria and benefits over a period of time
+type SchemeVersion struct {
+	ID            string     `json:"id"`
+	SchemeID      string     `json:"scheme_id"`
+	Version       int        `json:"version"`
+	Name          string     `json:"name"`
+	EffectiveFrom string     `json:"effective_from"`
+	EffectiveTo   *string    `json:"effective_to"` // Exclusive, nil while the version is the latest
+	CreatedAt     string     `json:"created_at"`
+	Criteria      []Criteria `json:"criteria"`
+	Benefits      []Benefit  `json:"benefits"`
+}
+
+// SchemeVersionDiff is what changed between two versions of a scheme
+type SchemeVersionDiff struct {
+	SchemeID        string       `json:"scheme_id"`
+	FromVersion     int          `json:"from_version"`
+	ToVersion       int          `json:"to_version"`
+	Name            *ValueChange `json:"name,omitempty"` // nil if the name did not change
+	CriteriaAdded   []Criteria   `json:"criteria_added"`
+	CriteriaRemoved []Criteria   `json:"criteria_removed"`
+	BenefitsAdded   []Benefit    `json:"benefits_added"`
+	BenefitsRemoved []Benefit    `json:"benefits_removed"`
+}
+
+// ValueChange is a value before and after a change
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
 }
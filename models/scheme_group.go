@@ -0,0 +1,23 @@
+package models
+
+// SchemeGroup links schemes that are alternatives to each other, or whose benefits are capped together
+// - In an exclusive group, an applicant can only be granted one of the schemes
+// - MaxCombinedAmount caps the total paid to an applicant across the group's schemes
+// - Both apply to grants within PeriodMonths of each other, or to all grants if it is nil
+type SchemeGroup struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Exclusive         bool     `json:"exclusive"`
+	MaxCombinedAmount *Money   `json:"max_combined_amount,omitempty"`
+	Currency          string   `json:"currency"` // Of MaxCombinedAmount, defaults to SGD
+	PeriodMonths      *int     `json:"period_months,omitempty"`
+	SchemeIDs         []string `json:"scheme_ids"`
+}
+
+// GroupConflict is why an applicant cannot be granted a scheme they are otherwise eligible for
+type GroupConflict struct {
+	GroupID        string   `json:"group_id"`
+	GroupName      string   `json:"group_name"`
+	Reason         string   `json:"reason"`
+	ApplicationIDs []string `json:"application_ids"` // The existing grants that exclude it
+}
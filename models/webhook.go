@@ -0,0 +1,55 @@
+package models
+
+// WebhookSubscription is an endpoint that is sent events of the types it subscribes to
+type WebhookSubscription struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Active     bool     `json:"active"`
+	Secret     string   `json:"secret,omitempty"` // Only shown when the subscription is created, to check signatures with
+	CreatedAt  string   `json:"created_at"`
+}
+
+// WebhookSubscriptionUpdate is a change to a subscription, where fields that are left out are kept as they are
+type WebhookSubscriptionUpdate struct {
+	URL        *string   `json:"url"`
+	EventTypes *[]string `json:"event_types"`
+	Active     *bool     `json:"active"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to one subscription
+type WebhookDelivery struct {
+	ID             string           `json:"id"`
+	SubscriptionID string           `json:"subscription_id"`
+	EventID        string           `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	Status         string           `json:"status"` // pending, delivered or failed once every attempt is used up
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *string          `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int             `json:"last_status_code,omitempty"`
+	LastError      *string          `json:"last_error,omitempty"`
+	DeliveredAt    *string          `json:"delivered_at,omitempty"`
+	CreatedAt      string           `json:"created_at"`
+	Log            []WebhookAttempt `json:"log"`
+}
+
+// WebhookAttempt is one try at sending a delivery
+type WebhookAttempt struct {
+	Attempt     int     `json:"attempt"`
+	StatusCode  *int    `json:"status_code,omitempty"` // nil if no response was received
+	Error       *string `json:"error,omitempty"`
+	DurationMs  int64   `json:"duration_ms"`
+	AttemptedAt string  `json:"attempted_at"`
+}
+
+// DisbursementsScheduled is the data of a disbursement.scheduled event
+type DisbursementsScheduled struct {
+	ApplicationID string         `json:"application_id"`
+	Disbursements []Disbursement `json:"disbursements"`
+}
+
+// SchemeUpdated is the data of a scheme.updated event
+type SchemeUpdated struct {
+	SchemeID  string `json:"scheme_id"`
+	VersionID string `json:"version_id"` // The latest version, which is new if one was published
+}
@@ -0,0 +1,67 @@
+package notifications
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ways of reaching an applicant
+const (
+	Email = "email"
+	SMS   = "sms"
+)
+
+// Channel sends a message to a recipient, such as an email address or phone number
+type Channel interface {
+	Send(to, subject, body string) error
+}
+
+// The channel used for each way of reaching an applicant, set up by Init
+var Channels map[string]Channel
+
+// Function to set up the channels from our .env variables
+// - There is no email or SMS provider yet, so messages go to a sink for development and testing
+// - NOTIFICATION_DIR writes each channel's messages to <channel>.log in that directory, otherwise they are written to stdout
+func Init() {
+	dir := os.Getenv("NOTIFICATION_DIR")
+	if dir == "" {
+		Channels = map[string]Channel{Email: NewWriterChannel(Email, os.Stdout), SMS: NewWriterChannel(SMS, os.Stdout)}
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		log.Fatalf("Error creating notification directory: %v", err)
+	}
+	Channels = make(map[string]Channel)
+	for _, name := range []string{Email, SMS} {
+		file, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			log.Fatalf("Error opening %s notification log: %v", name, err)
+		}
+		Channels[name] = NewWriterChannel(name, file)
+	}
+}
+
+// WriterChannel writes each message it is given to a writer, in place of sending it
+type WriterChannel struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// Create a channel that writes its messages to w
+func NewWriterChannel(name string, w io.Writer) *WriterChannel {
+	return &WriterChannel{name: name, w: w}
+}
+
+func (c *WriterChannel) Send(to, subject, body string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintf(c.w, "--- %s %s\nTo: %s\nSubject: %s\n\n%s\n\n", c.name, time.Now().UTC().Format(time.RFC3339), to, subject, body)
+	return err
+}
@@ -0,0 +1,93 @@
+package notifications
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+)
+
+const (
+	pollInterval = 5 * time.Second
+	batchSize    = 50
+)
+
+// Start sending queued notifications in the background
+// - Notifications are queued in the same transaction as the change they are about, so nothing is sent for a change that rolls back
+func StartSender() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			for i := 0; i < batchSize; i++ {
+				sent, err := sendNext()
+				if err != nil {
+					log.Printf("Error sending notification: %v", err)
+				}
+				if !sent {
+					break
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Send the oldest pending notification, returning false if there was none
+// - The row stays locked while it is sent, so that other instances skip it
+func sendNext() (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id, channel, recipient, subject, body string
+	err = tx.QueryRow(`
+		SELECT id, channel, recipient, subject, body FROM notifications
+		WHERE status = 'pending'
+		ORDER BY created_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`).Scan(&id, &channel, &recipient, &subject, &body)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sendErr := send(channel, recipient, subject, body)
+	if sendErr != nil {
+		_, err = tx.Exec(`UPDATE notifications SET status = 'failed', error = $1 WHERE id = $2`, sendErr.Error(), id)
+	} else {
+		_, err = tx.Exec(`UPDATE notifications SET status = 'sent', sent_at = NOW() WHERE id = $1`, id)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Send an encrypted message through a channel to its encrypted recipient
+func send(channel, encryptedRecipient, encryptedSubject, encryptedBody string) error {
+	sender, ok := Channels[channel]
+	if !ok {
+		return fmt.Errorf("unknown channel %q", channel)
+	}
+	recipient, err := encryption.Decrypt(encryptedRecipient)
+	if err != nil {
+		return fmt.Errorf("decrypting recipient: %v", err)
+	}
+	subject, err := encryption.Decrypt(encryptedSubject)
+	if err != nil {
+		return fmt.Errorf("decrypting subject: %v", err)
+	}
+	body, err := encryption.Decrypt(encryptedBody)
+	if err != nil {
+		return fmt.Errorf("decrypting body: %v", err)
+	}
+	return sender.Send(recipient, subject, body)
+}
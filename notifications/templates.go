@@ -0,0 +1,176 @@
+package notifications
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// Events applicants are told about
+const (
+	ApplicationApproved = "application.approved"
+	ApplicationRejected = "application.rejected"
+	SchemeEligible      = "scheme.eligible" // The applicant qualifies for a scheme they have not applied to
+)
+
+// Languages messages are written in, with English used when there is no translation
+const DefaultLanguage = "en"
+
+var Languages = []string{"en", "zh", "ms"}
+
+// Check whether messages can be written in a language
+func IsLanguage(language string) bool {
+	for _, valid := range Languages {
+		if language == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Data is what a message can refer to
+type Data struct {
+	ApplicantName string
+	SchemeName    string
+	ApplicationID string // Empty for messages that are not about an application
+}
+
+// Template is the subject and body of a message, which are Go text/templates over Data
+// - SMS messages have no subject
+type Template struct {
+	Subject string
+	Body    string
+}
+
+// Templates by event, language and channel
+var templateSources = map[string]map[string]map[string]Template{
+	ApplicationApproved: {
+		"en": {
+			Email: {
+				Subject: "Your application for {{.SchemeName}} has been approved",
+				Body: "Dear {{.ApplicantName}},\n\nYour application for {{.SchemeName}} (reference {{.ApplicationID}}) has been approved. " +
+					"We will let you know when your payments are made.",
+			},
+			SMS: {Body: "Your application for {{.SchemeName}} (ref {{.ApplicationID}}) has been approved."},
+		},
+		"zh": {
+			Email: {
+				Subject: "您的{{.SchemeName}}申请已获批准",
+				Body:    "{{.ApplicantName}}您好，\n\n您的{{.SchemeName}}申请（编号 {{.ApplicationID}}）已获批准。款项发放时我们会通知您。",
+			},
+			SMS: {Body: "您的{{.SchemeName}}申请（编号 {{.ApplicationID}}）已获批准。"},
+		},
+		"ms": {
+			Email: {
+				Subject: "Permohonan anda untuk {{.SchemeName}} telah diluluskan",
+				Body: "{{.ApplicantName}} yang dihormati,\n\nPermohonan anda untuk {{.SchemeName}} (rujukan {{.ApplicationID}}) telah diluluskan. " +
+					"Kami akan memaklumkan anda apabila bayaran dibuat.",
+			},
+			SMS: {Body: "Permohonan anda untuk {{.SchemeName}} (ruj {{.ApplicationID}}) telah diluluskan."},
+		},
+	},
+	ApplicationRejected: {
+		"en": {
+			Email: {
+				Subject: "Your application for {{.SchemeName}} was not successful",
+				Body: "Dear {{.ApplicantName}},\n\nYour application for {{.SchemeName}} (reference {{.ApplicationID}}) was not successful. " +
+					"You may appeal this decision.",
+			},
+			SMS: {Body: "Your application for {{.SchemeName}} (ref {{.ApplicationID}}) was not successful. You may appeal this decision."},
+		},
+		"zh": {
+			Email: {
+				Subject: "您的{{.SchemeName}}申请未获批准",
+				Body:    "{{.ApplicantName}}您好，\n\n您的{{.SchemeName}}申请（编号 {{.ApplicationID}}）未获批准。您可以对此决定提出上诉。",
+			},
+			SMS: {Body: "您的{{.SchemeName}}申请（编号 {{.ApplicationID}}）未获批准。您可以提出上诉。"},
+		},
+		"ms": {
+			Email: {
+				Subject: "Permohonan anda untuk {{.SchemeName}} tidak berjaya",
+				Body: "{{.ApplicantName}} yang dihormati,\n\nPermohonan anda untuk {{.SchemeName}} (rujukan {{.ApplicationID}}) tidak berjaya. " +
+					"Anda boleh merayu keputusan ini.",
+			},
+			SMS: {Body: "Permohonan anda untuk {{.SchemeName}} (ruj {{.ApplicationID}}) tidak berjaya. Anda boleh merayu keputusan ini."},
+		},
+	},
+	SchemeEligible: {
+		"en": {
+			Email: {
+				Subject: "You may qualify for {{.SchemeName}}",
+				Body: "Dear {{.ApplicantName}},\n\nBased on the details we hold, you may qualify for {{.SchemeName}}, " +
+					"which is now accepting applications. Speak to a caseworker to apply.",
+			},
+			SMS: {Body: "You may qualify for {{.SchemeName}}, which is now accepting applications. Speak to a caseworker to apply."},
+		},
+		"zh": {
+			Email: {
+				Subject: "您可能符合{{.SchemeName}}的资格",
+				Body:    "{{.ApplicantName}}您好，\n\n根据我们掌握的资料，您可能符合{{.SchemeName}}的资格，该计划现正接受申请。请联系个案工作者申请。",
+			},
+			SMS: {Body: "您可能符合{{.SchemeName}}的资格，该计划现正接受申请。请联系个案工作者申请。"},
+		},
+		"ms": {
+			Email: {
+				Subject: "Anda mungkin layak untuk {{.SchemeName}}",
+				Body: "{{.ApplicantName}} yang dihormati,\n\nBerdasarkan maklumat yang kami simpan, anda mungkin layak untuk {{.SchemeName}}, " +
+					"yang kini menerima permohonan. Hubungi pekerja kes untuk memohon.",
+			},
+			SMS: {Body: "Anda mungkin layak untuk {{.SchemeName}}, yang kini menerima permohonan. Hubungi pekerja kes untuk memohon."},
+		},
+	},
+}
+
+// A template parsed and ready to render
+type parsedTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Parsed templates, keyed the same way as templateSources
+var templates = func() map[string]map[string]map[string]parsedTemplate {
+	parse := func(name, source string) *template.Template {
+		return template.Must(template.New(name).Option("missingkey=error").Parse(source))
+	}
+	parsed := make(map[string]map[string]map[string]parsedTemplate)
+	for event, languages := range templateSources {
+		parsed[event] = make(map[string]map[string]parsedTemplate)
+		for language, channels := range languages {
+			parsed[event][language] = make(map[string]parsedTemplate)
+			for channel, source := range channels {
+				name := event + "/" + language + "/" + channel
+				parsed[event][language][channel] = parsedTemplate{
+					subject: parse(name+"/subject", source.Subject),
+					body:    parse(name+"/body", source.Body),
+				}
+			}
+		}
+	}
+	return parsed
+}()
+
+// Check whether applicants are told about an event
+func HasTemplate(event string) bool {
+	_, ok := templates[event]
+	return ok
+}
+
+// Render the message for an event in a language, falling back to English if it has not been translated
+func Render(event, language, channel string, data Data) (subject, body string, err error) {
+	tmpl, ok := templates[event][language][channel]
+	if !ok {
+		tmpl, ok = templates[event][DefaultLanguage][channel]
+	}
+	if !ok {
+		return "", "", fmt.Errorf("no %s template for %s", channel, event)
+	}
+
+	var subjectBuffer, bodyBuffer bytes.Buffer
+	if err = tmpl.subject.Execute(&subjectBuffer, data); err != nil {
+		return "", "", err
+	}
+	if err = tmpl.body.Execute(&bodyBuffer, data); err != nil {
+		return "", "", err
+	}
+	return subjectBuffer.String(), bodyBuffer.String(), nil
+}
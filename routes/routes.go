@@ -13,15 +13,77 @@ func SetupRouter() *mux.Router {
 	r.HandleFunc("/api/applicants", controllers.CreateApplicant).Methods("POST")
 	r.HandleFunc("/api/applicants", controllers.UpdateApplicant).Methods("PUT")
 	r.HandleFunc("/api/applicants", controllers.DeleteApplicant).Methods("DELETE")
+	r.HandleFunc("/api/applicants/export", controllers.ExportApplicant).Methods("GET")
+	r.HandleFunc("/api/applicants/anonymise", controllers.AnonymiseApplicant).Methods("POST")
+	r.HandleFunc("/api/applicants/duplicates", controllers.GetDuplicateCandidates).Methods("GET")
+	r.HandleFunc("/api/applicants/duplicates/scan", controllers.ScanDuplicates).Methods("POST")
+	r.HandleFunc("/api/applicants/duplicates/dismiss", controllers.DismissDuplicate).Methods("POST")
+	r.HandleFunc("/api/applicants/merge", controllers.MergeApplicants).Methods("POST")
+	r.HandleFunc("/api/applicants/merges", controllers.GetApplicantMerges).Methods("GET")
+	r.HandleFunc("/api/applicants/financials", controllers.GetFinancialRecords).Methods("GET")
+	r.HandleFunc("/api/applicants/financials", controllers.CreateFinancialRecord).Methods("POST")
+	r.HandleFunc("/api/applicants/household-finances", controllers.GetHouseholdFinances).Methods("GET")
+	r.HandleFunc("/api/applicants/marital-status", controllers.GetMaritalStatusHistory).Methods("GET")
+	r.HandleFunc("/api/applicants/marital-status", controllers.UpdateMaritalStatus).Methods("PUT")
+	r.HandleFunc("/api/applicants/contact", controllers.GetApplicantContact).Methods("GET")
+	r.HandleFunc("/api/applicants/contact", controllers.UpdateApplicantContact).Methods("PUT")
+	r.HandleFunc("/api/applicants/notifications", controllers.GetApplicantNotifications).Methods("GET")
 	r.HandleFunc("/api/schemes", controllers.GetSchemes).Methods("GET")
 	r.HandleFunc("/api/schemes", controllers.DeleteScheme).Methods("DELETE")
 	r.HandleFunc("/api/schemes", controllers.CreateScheme).Methods("POST")
 	r.HandleFunc("/api/schemes", controllers.UpdateScheme).Methods("PUT")
 	r.HandleFunc("/api/schemes/eligible", controllers.GetEligibleSchemes).Methods("GET")
+	r.HandleFunc("/api/schemes/versions", controllers.GetSchemeVersions).Methods("GET")
+	r.HandleFunc("/api/schemes/versions", controllers.PublishSchemeVersion).Methods("POST")
+	r.HandleFunc("/api/schemes/versions/diff", controllers.GetSchemeVersionDiff).Methods("GET")
+	r.HandleFunc("/api/schemes/{id}", controllers.GetScheme).Methods("GET")
+	r.HandleFunc("/api/schemes/{id}", controllers.UpdateScheme).Methods("PUT")
+	r.HandleFunc("/api/schemes/{id}/outreach", controllers.StartOutreach).Methods("POST")
+	r.HandleFunc("/api/outreach/jobs", controllers.GetOutreachJobs).Methods("GET")
+	r.HandleFunc("/api/outreach/matches", controllers.GetOutreachMatches).Methods("GET")
+	r.HandleFunc("/api/benefits", controllers.GetBenefits).Methods("GET")
+	r.HandleFunc("/api/benefits", controllers.CreateBenefit).Methods("POST")
+	r.HandleFunc("/api/benefits/{id}", controllers.UpdateBenefit).Methods("PUT")
+	r.HandleFunc("/api/benefits/{id}/retire", controllers.RetireBenefit).Methods("POST")
+	r.HandleFunc("/api/scheme-groups", controllers.GetSchemeGroups).Methods("GET")
+	r.HandleFunc("/api/scheme-groups", controllers.CreateSchemeGroup).Methods("POST")
+	r.HandleFunc("/api/scheme-groups/{id}", controllers.UpdateSchemeGroup).Methods("PUT")
+	r.HandleFunc("/api/scheme-groups/{id}", controllers.DeleteSchemeGroup).Methods("DELETE")
 	r.HandleFunc("/api/applications", controllers.GetApplications).Methods("GET")
 	r.HandleFunc("/api/applications", controllers.CreateApplication).Methods("POST")
 	r.HandleFunc("/api/applications", controllers.UpdateApplication).Methods("PUT")
 	r.HandleFunc("/api/applications", controllers.DeleteApplication).Methods("DELETE")
+	r.HandleFunc("/api/applications/eligibility", controllers.GetApplicationEligibility).Methods("GET")
+	r.HandleFunc("/api/applications/history", controllers.GetApplicationHistory).Methods("GET")
+	r.HandleFunc("/api/applications/assign", controllers.AssignApplication).Methods("POST")
+	r.HandleFunc("/api/applications/auto-assign", controllers.AutoAssignApplications).Methods("POST")
+	r.HandleFunc("/api/applications/{id}/notes", controllers.GetNotes).Methods("GET")
+	r.HandleFunc("/api/applications/{id}/notes", controllers.CreateNote).Methods("POST")
+	r.HandleFunc("/api/applications/{id}/attachments", controllers.GetAttachments).Methods("GET")
+	r.HandleFunc("/api/applications/{id}/attachments", controllers.UploadAttachment).Methods("POST")
+	r.HandleFunc("/api/applications/{id}/attachments/{attachmentID}", controllers.DownloadAttachment).Methods("GET")
+	r.HandleFunc("/api/applications/{id}/documents", controllers.GetApplicationDocuments).Methods("GET")
+	r.HandleFunc("/api/applications/{id}/documents", controllers.SubmitDocument).Methods("POST")
+	r.HandleFunc("/api/applications/{id}/documents/{type}/review", controllers.ReviewDocument).Methods("POST")
+	r.HandleFunc("/api/caseworkers", controllers.GetCaseworkers).Methods("GET")
+	r.HandleFunc("/api/caseworkers", controllers.CreateCaseworker).Methods("POST")
+	r.HandleFunc("/api/caseworkers/{id}", controllers.UpdateCaseworker).Methods("PUT")
+	r.HandleFunc("/api/queues/mine", controllers.GetMyQueue).Methods("GET")
+	r.HandleFunc("/api/queues/unassigned", controllers.GetUnassignedQueue).Methods("GET")
+	r.HandleFunc("/api/queues/overdue", controllers.GetOverdueQueue).Methods("GET")
+	r.HandleFunc("/api/appeals", controllers.GetAppeals).Methods("GET")
+	r.HandleFunc("/api/appeals", controllers.FileAppeal).Methods("POST")
+	r.HandleFunc("/api/appeals/{id}/assign", controllers.AssignAppeal).Methods("POST")
+	r.HandleFunc("/api/appeals/{id}/decide", controllers.DecideAppeal).Methods("POST")
+	r.HandleFunc("/api/webhooks", controllers.GetWebhookSubscriptions).Methods("GET")
+	r.HandleFunc("/api/webhooks", controllers.CreateWebhookSubscription).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id}", controllers.UpdateWebhookSubscription).Methods("PUT")
+	r.HandleFunc("/api/webhooks/{id}", controllers.DeleteWebhookSubscription).Methods("DELETE")
+	r.HandleFunc("/api/webhooks/{id}/deliveries", controllers.GetWebhookDeliveries).Methods("GET")
+	r.HandleFunc("/api/webhooks/{id}/deliveries/{deliveryID}/retry", controllers.RetryWebhookDelivery).Methods("POST")
+	r.HandleFunc("/api/disbursements", controllers.GetDisbursements).Methods("GET")
+	r.HandleFunc("/api/disbursements/totals", controllers.GetDisbursementTotals).Methods("GET")
+	r.HandleFunc("/api/reference/education-levels", controllers.GetEducationLevels).Methods("GET")
 	log.Println("Set up routes.")
 	return r
 }
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrNotFound is returned when no blob is stored under a key
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore holds files, such as application attachments, by key
+// - Keys are made of path segments separated by /, and are chosen by the caller
+type BlobStore interface {
+	// Put stores everything read from r under key, replacing any blob already there
+	Put(key string, r io.Reader) error
+	// Open reads the blob stored under key, returning ErrNotFound if there is none
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key, and does nothing if there is none
+	Delete(key string) error
+}
+
+// The store used by the app, set up by Init
+var Blobs BlobStore
+
+// Function to set up the blob store from our .env variables
+// - BLOB_STORE_DIR is the directory files are kept in, "blobs" by default
+func Init() {
+	dir := os.Getenv("BLOB_STORE_DIR")
+	if dir == "" {
+		dir = "blobs"
+	}
+
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		log.Fatalf("Error setting up blob store: %v", err)
+	}
+	Blobs = store
+}
@@ -1,32 +1,172 @@
 package utils
 
-import "time"
+import (
+	"fmt"
+	"time"
 
-// Helper function to calculate education level based on age
+	"github.com/neozhixuan/gt_assessment/config"
+)
+
+// Layout of dates stored and accepted by the API, e.g. 2006-01-02
+const DateLayout = "2006-01-02"
+
+// Marital statuses allowed by the criteria and applicants tables
+var MaritalStatuses = []string{"single", "married", "widowed", "divorced"}
+
+// Check that a marital status is one we recognise
+func IsValidMaritalStatus(status string) bool {
+	for _, valid := range MaritalStatuses {
+		if status == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Benefit types allowed by the benefits table
+var BenefitTypes = []string{"cash", "voucher", "in_kind", "subsidy_percentage"}
+
+// Check that a benefit type is one we recognise
+func IsValidBenefitType(benefitType string) bool {
+	for _, valid := range BenefitTypes {
+		if benefitType == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// How often a benefit can be paid
+var BenefitFrequencies = []string{"one_off", "monthly", "quarterly"}
+
+// Check that a benefit frequency is one we recognise
+func IsValidBenefitFrequency(frequency string) bool {
+	for _, valid := range BenefitFrequencies {
+		if frequency == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Statuses a scheme can be in
+var SchemeStatuses = []string{"draft", "open", "closed", "archived"}
+
+// Check that a scheme status is one we recognise
+func IsValidSchemeStatus(status string) bool {
+	for _, valid := range SchemeStatuses {
+		if status == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Application statuses that are a final decision, after which the applicant may apply to the scheme again
+var DecidedApplicationStatuses = []string{"approved", "rejected", "withdrawn"}
+
+// Check whether an application has been decided, rather than still being worked on
+func IsDecidedApplicationStatus(status string) bool {
+	for _, decided := range DecidedApplicationStatuses {
+		if status == decided {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that a currency code looks like an ISO 4217 code, e.g. SGD
+func IsValidCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, letter := range code {
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to calculate education level based on age, using the configured bands
 func CalculateEducationLevel(age int) string {
-	if age <= 6 {
-		return "kindergarten"
-	} else if age <= 12 {
-		return "primary"
-	} else if age <= 16 {
-		return "secondary"
-	} else if age <= 18 {
-		return "tertiary"
-	} else {
-		return "higher"
-	}
-}
-
-// Calculate age of child
-func CalculateAge(dob string) int {
-	parsedDOB, _ := time.Parse(time.RFC3339, dob)
+	for _, level := range config.EducationLevels {
+		if age >= level.MinAge && (level.MaxAge == nil || age <= *level.MaxAge) {
+			return level.Name
+		}
+	}
+	return ""
+}
+
+// Check that an education level is one of the configured levels
+func IsValidEducationLevel(name string) bool {
+	for _, level := range config.EducationLevels {
+		if name == level.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out a child's education level on a date
+// - An explicit override (e.g. a child held back a year) wins over the level derived from their age
+func EducationLevelOn(dob string, override string, on time.Time) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	age, err := CalculateSchoolAge(dob, on)
+	if err != nil {
+		return "", err
+	}
+	return CalculateEducationLevel(age), nil
+}
+
+// Check that a date of birth is in YYYY-MM-DD format and not in the future
+// - Ages and education levels cannot be worked out for someone not born yet
+func ValidateDateOfBirth(dob string) error {
+	parsedDOB, err := time.Parse(DateLayout, dob)
+	if err != nil {
+		return fmt.Errorf("date_of_birth must be in YYYY-MM-DD format")
+	}
 	now := time.Now()
-	years := now.Year() - parsedDOB.Year()
+	if parsedDOB.After(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)) {
+		return fmt.Errorf("date_of_birth cannot be in the future")
+	}
+	return nil
+}
+
+// Calculate someone's age in whole years on a date
+func CalculateAge(dob string, on time.Time) (int, error) {
+	parsedDOB, err := time.Parse(DateLayout, dob)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date of birth %q: %v", dob, err)
+	}
+	on = time.Date(on.Year(), on.Month(), on.Day(), 0, 0, 0, 0, time.UTC)
+	if parsedDOB.After(on) {
+		return 0, fmt.Errorf("date of birth %s is after %s", dob, on.Format(DateLayout))
+	}
 
-	if now.YearDay() < parsedDOB.YearDay() {
+	// Take a year off if the birthday has not come yet
+	years := on.Year() - parsedDOB.Year()
+	if on.Month() < parsedDOB.Month() || (on.Month() == parsedDOB.Month() && on.Day() < parsedDOB.Day()) {
 		years--
 	}
-	return years
+	return years, nil
+}
+
+// Calculate a child's age as of 1 January of the school year a date falls in
+// - Children born during that year count as 0
+func CalculateSchoolAge(dob string, on time.Time) (int, error) {
+	// Check the date of birth against the actual date, so that future dates are still rejected
+	if _, err := CalculateAge(dob, on); err != nil {
+		return 0, err
+	}
+
+	startOfSchoolYear := time.Date(on.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	if dob >= startOfSchoolYear.Format(DateLayout) {
+		return 0, nil
+	}
+	return CalculateAge(dob, startOfSchoolYear)
 }
 
 // nilIfEmpty function
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// Check letters for each NRIC/FIN series, indexed by the weighted sum modulo 11
+var nationalIDCheckLetters = map[byte]string{
+	'S': "JZIHGFEDCBA",
+	'T': "JZIHGFEDCBA",
+	'F': "XWUTRQPNMLK",
+	'G': "XWUTRQPNMLK",
+	'M': "XWUTRQPNJLK",
+}
+
+// Weights applied to the seven digits of an NRIC/FIN
+var nationalIDWeights = []int{2, 7, 6, 5, 4, 3, 2}
+
+// Normalise a national ID to the form we validate and index, e.g. " s1234567d " to "S1234567D"
+func NormaliseNationalID(id string) string {
+	return strings.ToUpper(strings.TrimSpace(id))
+}
+
+// Validate the format and check letter of an NRIC/FIN style national ID
+// - A prefix letter (S, T, F, G or M), seven digits and a check letter, e.g. S1234567D
+func ValidateNationalID(id string) error {
+	id = NormaliseNationalID(id)
+	if len(id) != 9 {
+		return errors.New("national ID must be 9 characters long")
+	}
+
+	checkLetters, ok := nationalIDCheckLetters[id[0]]
+	if !ok {
+		return errors.New("national ID must start with S, T, F, G or M")
+	}
+
+	// Weighted sum of the digits
+	sum := 0
+	for i, weight := range nationalIDWeights {
+		digit := id[i+1]
+		if digit < '0' || digit > '9' {
+			return errors.New("national ID must have seven digits after the prefix")
+		}
+		sum += int(digit-'0') * weight
+	}
+
+	// The newer series are offset so that their check letters differ from the older ones
+	switch id[0] {
+	case 'T', 'G':
+		sum += 4
+	case 'M':
+		sum += 3
+	}
+
+	if id[8] != checkLetters[sum%11] {
+		return errors.New("national ID check letter is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package utils
+
+import "net/http"
+
+// Header naming the caseworker making a request
+const UserHeader = "X-User"
+
+// The caseworker making a request, or "" if the request does not say
+// - There is no authentication yet, so the header is trusted as given
+func RequestUser(r *http.Request) string {
+	return r.Header.Get(UserHeader)
+}
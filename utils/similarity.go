@@ -0,0 +1,44 @@
+package utils
+
+import "strings"
+
+// Score how alike two names are, from 0 (nothing in common) to 1 (identical)
+// - Uses the Levenshtein edit distance, ignoring case and extra spaces
+func NameSimilarity(a, b string) float64 {
+	a = strings.Join(strings.Fields(strings.ToLower(a)), " ")
+	b = strings.Join(strings.Fields(strings.ToLower(b)), " ")
+
+	first, second := []rune(a), []rune(b)
+	longest := len(first)
+	if len(second) > longest {
+		longest = len(second)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	return 1 - float64(levenshtein(first, second))/float64(longest)
+}
+
+// Count the single character insertions, deletions and substitutions needed to turn a into b
+func levenshtein(a, b []rune) int {
+	// We only need the previous row of the distance matrix to compute the current one
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
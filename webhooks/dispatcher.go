@@ -0,0 +1,234 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neozhixuan/gt_assessment/database"
+	"github.com/neozhixuan/gt_assessment/encryption"
+)
+
+const (
+	pollInterval   = 5 * time.Second
+	batchSize      = 50
+	requestTimeout = 10 * time.Second
+	// A claimed delivery is left alone for this long, so that another instance can pick it up if this one dies mid-request
+	claimLease = time.Minute
+	// Retries wait 30s, 1m, 2m and so on, up to an hour, and give up after MaxAttempts
+	MaxAttempts = 8
+	baseBackoff = 30 * time.Second
+	maxBackoff  = time.Hour
+)
+
+var client = &http.Client{Timeout: requestTimeout}
+
+// A delivery claimed for sending, with what is needed to send it
+type claimedDelivery struct {
+	id        string
+	attempts  int
+	url       string
+	secret    string
+	eventID   string
+	eventType string
+	payload   json.RawMessage
+	createdAt time.Time
+}
+
+// Start sending webhooks in the background
+// - Each round hands new outbox events to their subscribers, then sends the deliveries that are due
+func StartDispatcher() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			if err := fanOut(); err != nil {
+				log.Printf("Error dispatching webhook events: %v", err)
+			}
+			if err := deliverDue(); err != nil {
+				log.Printf("Error delivering webhooks: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Create a delivery for each active subscription to each new event, and mark the events dispatched
+// - SKIP LOCKED lets several instances run the dispatcher without handing out an event twice
+func fanOut() error {
+	_, err := database.DB.Exec(`
+		WITH events AS (
+			SELECT id, event_type FROM outbox_events
+			WHERE dispatched_at IS NULL
+			ORDER BY created_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), deliveries AS (
+			INSERT INTO webhook_deliveries (id, subscription_id, event_id)
+			SELECT gen_random_uuid(), webhook_subscriptions.id, events.id
+			FROM events JOIN webhook_subscriptions
+				ON webhook_subscriptions.active AND events.event_type = ANY(webhook_subscriptions.event_types)
+		)
+		UPDATE outbox_events SET dispatched_at = NOW() WHERE id IN (SELECT id FROM events)`, batchSize)
+	return err
+}
+
+// Claim the deliveries that are due and send them
+// - Deliveries to paused subscriptions stay pending, and are sent once the subscription is active again
+func deliverDue() error {
+	rows, err := database.DB.Query(`
+		UPDATE webhook_deliveries SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		FROM webhook_subscriptions, outbox_events
+		WHERE webhook_deliveries.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			AND subscription_id IN (SELECT id FROM webhook_subscriptions WHERE active)
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		AND webhook_subscriptions.id = webhook_deliveries.subscription_id AND webhook_subscriptions.active
+		AND outbox_events.id = webhook_deliveries.event_id
+		RETURNING webhook_deliveries.id, webhook_deliveries.attempts, webhook_subscriptions.url, webhook_subscriptions.secret,
+			outbox_events.id, outbox_events.event_type, outbox_events.payload, outbox_events.created_at`,
+		batchSize, claimLease.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	claimed := []claimedDelivery{}
+	for rows.Next() {
+		var delivery claimedDelivery
+		err := rows.Scan(&delivery.id, &delivery.attempts, &delivery.url, &delivery.secret,
+			&delivery.eventID, &delivery.eventType, &delivery.payload, &delivery.createdAt)
+		if err != nil {
+			return err
+		}
+		claimed = append(claimed, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range claimed {
+		wg.Add(1)
+		go func(delivery claimedDelivery) {
+			defer wg.Done()
+			if err := deliver(delivery); err != nil {
+				log.Printf("Error recording webhook delivery %s: %v", delivery.id, err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Send one delivery, log the attempt, and schedule a retry if it failed
+func deliver(delivery claimedDelivery) error {
+	attempt := delivery.attempts + 1
+	started := time.Now()
+	statusCode, sendErr := send(delivery)
+	duration := time.Since(started).Milliseconds()
+
+	var errorMessage *string
+	if sendErr != nil {
+		message := sendErr.Error()
+		errorMessage = &message
+	}
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO webhook_delivery_attempts (id, delivery_id, attempt, status_code, error, duration_ms)
+		VALUES (gen_random_uuid(), $1, $2, $3, $4, $5)`, delivery.id, attempt, code, errorMessage, duration)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sendErr == nil:
+		_, err = tx.Exec(`
+			UPDATE webhook_deliveries SET status = 'delivered', attempts = $1, last_status_code = $2, last_error = NULL,
+				delivered_at = NOW(), next_attempt_at = NULL
+			WHERE id = $3`, attempt, code, delivery.id)
+	case attempt >= MaxAttempts:
+		_, err = tx.Exec(`
+			UPDATE webhook_deliveries SET status = 'failed', attempts = $1, last_status_code = $2, last_error = $3, next_attempt_at = NULL
+			WHERE id = $4`, attempt, code, errorMessage, delivery.id)
+	default:
+		_, err = tx.Exec(`
+			UPDATE webhook_deliveries SET attempts = $1, last_status_code = $2, last_error = $3,
+				next_attempt_at = NOW() + $4 * INTERVAL '1 second'
+			WHERE id = $5`, attempt, code, errorMessage, backoff(attempt).Seconds(), delivery.id)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// POST the event to the subscriber, returning the response status and an error unless it was a 2xx
+func send(delivery claimedDelivery) (int, error) {
+	secret, err := encryption.Decrypt(delivery.secret)
+	if err != nil {
+		return 0, fmt.Errorf("decrypting secret: %v", err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         delivery.eventID,
+		"type":       delivery.eventType,
+		"created_at": delivery.createdAt.UTC().Format(time.RFC3339),
+		"data":       delivery.payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Id", delivery.eventID)
+	request.Header.Set("X-Webhook-Event", delivery.eventType)
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Webhook-Signature", "sha256="+Sign(secret, timestamp, body))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("subscriber responded with %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// How long to wait after a failed attempt before trying again
+func backoff(attempt int) time.Duration {
+	wait := time.Duration(float64(baseBackoff) * math.Pow(2, float64(attempt-1)))
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
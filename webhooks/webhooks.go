@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Events that can be subscribed to
+const (
+	ApplicationCreated       = "application.created"
+	ApplicationStatusChanged = "application.status_changed"
+	DisbursementScheduled    = "disbursement.scheduled"
+	SchemeUpdated            = "scheme.updated"
+	OutreachMatched          = "outreach.matched"
+)
+
+// Every event type, in the order they are documented
+var EventTypes = []string{ApplicationCreated, ApplicationStatusChanged, DisbursementScheduled, SchemeUpdated, OutreachMatched}
+
+// Check whether an event type can be subscribed to
+func IsEventType(eventType string) bool {
+	for _, valid := range EventTypes {
+		if eventType == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Record an event in the outbox as part of a transaction
+// - The event is only sent once the transaction commits, and is never lost if it does
+func Enqueue(tx *sql.Tx, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO outbox_events (id, event_type, payload) VALUES ($1, $2, $3)`,
+		uuid.New().String(), eventType, payload)
+	return err
+}
+
+// Sign a request body for a subscriber, who can check it with their secret
+// - The signature is the hex HMAC-SHA256 of "<timestamp>.<body>", so an old request cannot be replayed with a new timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}